@@ -11,6 +11,13 @@ import (
 
 	"github.com/rs/zerolog"
 	. "github.com/spring-epfl/private-collection-matching/pkg/psm"
+	"github.com/spring-epfl/private-collection-matching/pkg/psm/docsearch"
+)
+
+// Random compounds have up to 64 of the 166 bits of a MACCS fingerprint (elements in [1, 166))
+const (
+	randCompoundSize   = 64
+	randCompoundDomain = 166
 )
 
 func RunCLIBench(cli_type string) {
@@ -24,8 +31,10 @@ func RunCLIBench(cli_type string) {
 	}
 	nsPtr := flag.Int("ns", 1024, "Number of server "+set_name+".")
 	lognPtr := flag.Int("logn", 15, "BFV polynomial degree")
+	autoParamsPtr := flag.Bool("auto-params", false, "Choose the BFV and packing parameters from the workload (ignores -logn).")
 
-	aggregationPtr := flag.String("agg", "x-ms", "Aggregation function used to compute the collection-wide response. ['naive', 'x-ms', 'ca-ms']")
+	aggregationPtr := flag.String("agg", "x-ms", "Aggregation function used to compute the collection-wide response. ['naive', 'x-ms', 'ca-ms', 'th-ms']")
+	thresholdPtr := flag.Int("threshold", 1, "Number of matching sets required by the 'th-ms' aggregation.")
 
 	// Manage
 	repPtr := flag.Int("r", 1, "Number of times repeating the experiment")
@@ -34,22 +43,32 @@ func RunCLIBench(cli_type string) {
 	outAddrPtr := flag.String("o", "bench.json", "Address of json output")
 
 	var sdSize, maxDocQuerySize, maxDocSize, hashPerKw int
-	var chembl string
+	var chembl, corpusDir, keywords, keyFile, metric, psiLayer string
+	tversky := DefaultTverskyParams()
 
 	// chemical
 	if cli_type == "chemical" {
 		flag.IntVar(&sdSize, "sd-domain-size", 256, "Size of the compound fingerprint. Must be a power of 2.") // The size of MACCS keys is 167
 		flag.StringVar(&chembl, "chemdb-path", "", "Address of a chemical fingerprint dataset. (if empty '', uses randomly generated compounds)")
+		flag.Float64Var(&tversky.Alpha, "tv-alpha", tversky.Alpha, "Tversky alpha parameter (weight of the query-only bits).")
+		flag.Float64Var(&tversky.Beta, "tv-beta", tversky.Beta, "Tversky beta parameter (weight of the compound-only bits).")
+		flag.Float64Var(&tversky.Threshold, "tv-threshold", tversky.Threshold, "Tversky similarity threshold in (0, 1].")
+		flag.IntVar(&tversky.MaxCardinality, "tv-max-card", tversky.MaxCardinality, "Largest intersection cardinality detected by the Tversky range check.")
+		flag.StringVar(&metric, "metric", "tversky", "Similarity metric, the other metrics take -tv-threshold and -tv-max-card. ['tversky', 'jaccard' ('tanimoto'), 'dice', 'cosine', 'overlap']")
 	}
 	// document
 	if cli_type == "document" {
 		flag.IntVar(&maxDocQuerySize, "max-q", 8, "Maximum number of keywords in a query. Must be a power of 2.")
-		flag.IntVar(&maxDocSize, "max-doc", 128, "Maximum number of keywords in a query. Must be a power of 2.")
-		flag.IntVar(&hashPerKw, "hash-per-kw", 2, "Number of hash functions used for each keyword. Determines the false-positive rate. Must be a power of 2.") // we simulate the cost of having multiple hash per keyword by increasing the set sizes without doing the hash management
+		flag.IntVar(&maxDocSize, "max-doc", 128, "Maximum number of keywords in a document. Must be a power of 2.")
+		flag.IntVar(&hashPerKw, "hash-per-kw", 2, "Number of hash functions used for each keyword. Determines the false-positive rate. Must be a power of 2.") // for random documents, we simulate the cost of having multiple hash per keyword by increasing the set sizes without doing the hash management
+		flag.StringVar(&corpusDir, "corpus", "", "Directory of text documents to search. (if empty '', uses randomly generated documents)")
+		flag.StringVar(&keywords, "keywords", "", "Query keywords searched in the corpus.")
+		flag.StringVar(&keyFile, "key-file", "", "File holding the secret key of the keyword encoding, shared by the client and the server (required with -corpus).")
 	}
 	// sd-comparison
 	if cli_type == "sd-comparison" {
 		flag.IntVar(&sdSize, "sd-domain-size", 256, "Size of the compound fingerprint. Must be a power of 2.")
+		flag.StringVar(&psiLayer, "psi", "ca", "PSI layer: intersection cardinality or intersection. ['ca', 'psi']")
 	}
 
 	flag.Parse()
@@ -63,22 +82,6 @@ func RunCLIBench(cli_type string) {
 		Logger.Info().Msgf("Setting logger level to 'Error'.")
 	}
 
-	bfvParams := GetBFVParam(*lognPtr)
-	pp := NewPSIParams(bfvParams, 128)
-	if cli_type == "chemical" || cli_type == "sd-comparison" {
-		if sdSize > 256 {
-			if (sdSize & (sdSize - 1)) != 0 {
-				panic("The small domain size (sd-domain-size) must be a power of 2.")
-			}
-			pp.SdBitVecLen = sdSize
-		}
-	} else if cli_type == "document" {
-		pp.MaxClientElemPerCtx = maxDocQuerySize * hashPerKw
-		pp.ClRepNum = int(bfvParams.N()) / pp.MaxClientElemPerCtx / maxDocSize
-	}
-	pp.Update()
-	Logger.Info().Msgf("Param:\n%v\n", pp.Describe())
-
 	// Build the query
 	aggregation, agg_ok := ParseAggregationString(aggregationPtr)
 	if !agg_ok {
@@ -87,16 +90,143 @@ func RunCLIBench(cli_type string) {
 	var qt *QueryType
 	var err error
 	if cli_type == "chemical" {
-		qt, err = NewQueryType(true, PSI_CA, MATCHING_TVERSKY, aggregation)
+		matching, ok := ParseMatchingString(&metric)
+		if !ok || (matching != MATCHING_TVERSKY && matching != MATCHING_JACCARD && matching != MATCHING_DICE &&
+			matching != MATCHING_COSINE && matching != MATCHING_OVERLAP) {
+			panic(errors.New("unknown similarity metric"))
+		}
+		qt, err = NewQueryType(true, PSI_CA, matching, aggregation)
+		if err == nil {
+			qt.Tversky = tversky
+			qt.Similarity = SimilarityParams{Threshold: tversky.Threshold, MaxCardinality: tversky.MaxCardinality}
+		}
 	} else if cli_type == "document" {
 		qt, err = NewQueryType(false, PSI_PSI, MATCHING_FPSM, aggregation)
 	} else if cli_type == "sd-comparison" {
-		qt, err = NewQueryType(true, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+		psi, ok := ParsePsiString(&psiLayer)
+		if !ok {
+			panic(errors.New("unknown psi layer"))
+		}
+		qt, err = NewQueryType(true, psi, MATCHING_NONE, AGGREGATION_NAIVE)
 	}
 
 	if err != nil {
 		panic(err)
 	}
+	qt.Threshold = *thresholdPtr
+
+	if cli_type == "document" && (maxDocSize < 1 || maxDocQuerySize < 1 || hashPerKw < 1) {
+		panic(errors.New("-max-doc, -max-q, and -hash-per-kw must be positive"))
+	}
+
+	// Real documents
+	var corpus []docsearch.Document
+	var cfg docsearch.Config
+	if corpusDir != "" {
+		if keywords == "" || keyFile == "" {
+			panic(errors.New("searching a corpus requires -keywords and -key-file"))
+		}
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			panic(err)
+		}
+		if len(key) == 0 {
+			panic(errors.New("the key file is empty"))
+		}
+		cfg = docsearch.DefaultConfig(key)
+		cfg.HashPerKeyword = hashPerKw
+		if corpus, err = docsearch.ReadCorpus(corpusDir); err != nil {
+			panic(err)
+		}
+		*nsPtr = len(corpus)
+		// Polynomials must fit the largest document, see the checks of the parameters below
+		for _, doc := range corpus {
+			if size := len(docsearch.Tokenize(doc.Text)) * hashPerKw; size >= maxDocSize {
+				maxDocSize = NextPow2(size + 1)
+			}
+		}
+	}
+
+	// Compounds of the database, read once so that the plan fits them
+	var compounds [][]uint64
+	if cli_type == "chemical" && chembl != "" {
+		compounds = ReadCompoundsFromFile(chembl, *nsPtr+1)
+	}
+
+	var pp *PSIParams
+	if *autoParamsPtr {
+		// The workload of the inputs generated (or read) below
+		workload := Workload{QueryType: *qt, CollectionSize: *nsPtr}
+		if cli_type == "chemical" && compounds != nil {
+			workload = measureWorkload(*qt, compounds)
+			if workload.Domain < uint64(sdSize) {
+				workload.Domain = uint64(sdSize)
+			}
+		} else if cli_type == "chemical" {
+			workload.ClientSetSize, workload.MaxServerSetSize = randCompoundSize, randCompoundSize
+			workload.Domain = uint64(sdSize)
+			if workload.Domain < randCompoundDomain {
+				workload.Domain = randCompoundDomain
+			}
+		} else if cli_type == "document" {
+			workload.ClientSetSize = maxDocQuerySize * hashPerKw
+			workload.MaxServerSetSize, workload.Domain = maxDocSize-1, 10000
+		} else if cli_type == "sd-comparison" {
+			workload.ClientSetSize, workload.MaxServerSetSize, workload.Domain = sdSize/2, sdSize/2, uint64(sdSize)
+		}
+		plan, err := PlanParams(workload)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Parameter plan:\n%v\n", plan.Describe())
+		pp = plan.NewPSIParams()
+	} else {
+		bfvParams := GetBFVParam(*lognPtr)
+		pp = NewPSIParams(bfvParams, 128)
+		if cli_type == "chemical" || cli_type == "sd-comparison" {
+			if sdSize > 256 {
+				if (sdSize & (sdSize - 1)) != 0 {
+					panic("The small domain size (sd-domain-size) must be a power of 2.")
+				}
+				pp.SdBitVecLen = sdSize
+			}
+		} else if cli_type == "document" {
+			pp.MaxClientElemPerCtx = maxDocQuerySize * hashPerKw
+			pp.ClRepNum = int(bfvParams.N()) / pp.MaxClientElemPerCtx / maxDocSize
+			if pp.ClRepNum < 1 {
+				panic(fmt.Errorf("documents of %v elements and queries of %v elements (keywords times -hash-per-kw) do not fit in N=2^%v slots",
+					maxDocSize-1, pp.MaxClientElemPerCtx, *lognPtr))
+			}
+		}
+		pp.Update()
+	}
+	Logger.Info().Msgf("Param:\n%v\n", pp.Describe())
+
+	// Search the corpus and map the results back to the documents
+	var index *docsearch.Index
+	if corpus != nil {
+		if index, err = docsearch.NewIndex(pp, cfg, corpus); err != nil {
+			panic(err)
+		}
+		cl := NewClientFor(pp, docsearch.QueryType())
+		searcher, err := docsearch.NewSearcher(pp, cl, cfg)
+		if err != nil {
+			panic(err)
+		}
+		query, err := searcher.Query([]string{keywords})
+		if err != nil {
+			panic(err)
+		}
+		resp, err := index.Respond(query, cl.GetKey())
+		if err != nil {
+			panic(err)
+		}
+		ids, err := searcher.Results(query, resp, index.IDs())
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Documents matching %q: %v\n", keywords, ids)
+	}
 
 	data := make([]BenchData, *repPtr)
 	for i := 0; i < *repPtr; i++ {
@@ -107,14 +237,21 @@ func RunCLIBench(cli_type string) {
 			if chembl != "" {
 				// Read compounds
 				fmt.Println("Use chemicals loaded from a database")
-				sets = ReadCompoundsFromFile(chembl, *nsPtr+1)
+				sets = compounds
 			} else {
 				// random compounds
-				sets, err = RandomDataSet(*nsPtr+1, 3, 64, 166)
+				sets, err = RandomDataSet(*nsPtr+1, 3, randCompoundSize, randCompoundDomain)
 				if err != nil {
 					panic(err)
 				}
 			}
+		} else if cli_type == "document" && corpus != nil {
+			fmt.Println("Use documents loaded from a corpus")
+			sets = make([][]uint64, 1, len(corpus)+1)
+			if sets[0], err = docsearch.EncodeKeywords(pp, cfg, []string{keywords}); err != nil {
+				panic(err)
+			}
+			sets = append(sets, index.Sets()...)
 		} else if cli_type == "document" {
 			// Random documents
 			sets, err = RandomDataSet(*nsPtr+1, 8, maxDocSize-2, 10000)
@@ -140,3 +277,19 @@ func RunCLIBench(cli_type string) {
 	file, _ := json.MarshalIndent(data, "", " ")
 	_ = ioutil.WriteFile(*outAddrPtr, file, 0644)
 }
+
+// Workload of the inputs of a benchmark: sets[0] is the client set, the others are the server sets
+func measureWorkload(qt QueryType, sets [][]uint64) Workload {
+	w := Workload{QueryType: qt, ClientSetSize: len(sets[0]), CollectionSize: len(sets) - 1, Domain: 1}
+	for i, set := range sets {
+		if i > 0 && len(set) > w.MaxServerSetSize {
+			w.MaxServerSetSize = len(set)
+		}
+		for _, v := range set {
+			if v >= w.Domain {
+				w.Domain = v + 1
+			}
+		}
+	}
+	return w
+}
@@ -7,6 +7,6 @@ require (
 	github.com/mattn/go-runewidth v0.0.12 // indirect
 	github.com/rs/zerolog v1.27.0
 	github.com/schollz/progressbar/v3 v3.7.6
-	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/term v0.0.0-20210406210042-72f3dc4e9b72 // indirect
 )
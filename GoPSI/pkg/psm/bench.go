@@ -27,7 +27,7 @@ func BenchHomoPSI(pp *PSIParams, sets [][]uint64, queryType QueryType) BenchData
 
 	// DescribeParams(pp.params)
 
-	cl := NewClient(pp)
+	cl := NewClientFor(pp, queryType)
 	keyGenTime := time.Now()
 	sv, err := NewServer(pp, serverSets)
 	if err != nil {
@@ -7,19 +7,19 @@ import (
 )
 
 // NOTE: Fixing params can allow more preprocess
-type client struct {
+type Client struct {
 	pp        *PSIParams
 	pk        *bfv.PublicKey
 	evk       *bfv.EvaluationKey
 	sk        *bfv.SecretKey
+	key       *ClientKey
 	encoder   bfv.Encoder
 	encryptor bfv.Encryptor
 	decryptor bfv.Decryptor
 }
 
-func NewClient(pp *PSIParams) *client {
-	cl := new(client)
-	cl.pp = pp
+// NewClient creates a client with rotation keys for all the supported query types.
+func NewClient(pp *PSIParams) *Client {
 	params := pp.params
 
 	// Needs to be in sync with param and operation
@@ -30,15 +30,46 @@ func NewClient(pp *PSIParams) *client {
 	rots = append(rots, -1)
 
 	keyGen := bfv.NewKeyGenerator(params)
-	cl.sk, cl.pk = keyGen.GenKeyPair()
-	rlk := keyGen.GenRelinearizationKey(cl.sk, 2)
 	// include row swap and all pow(2)
-	rtk := keyGen.GenRotationKeysForRotations(rots, true, cl.sk)
-	cl.evk = &bfv.EvaluationKey{
+	rtk := func(sk *bfv.SecretKey) *bfv.RotationKeySet {
+		return keyGen.GenRotationKeysForRotations(rots, true, sk)
+	}
+	return newClientWithRotations(pp, keyGen, rtk)
+}
+
+// NewClientFor creates a client that only generates the rotation keys needed by the given query types.
+func NewClientFor(pp *PSIParams, queryTypes ...QueryType) *Client {
+	galEls := RequiredGaloisElements(pp, queryTypes...)
+
+	keyGen := bfv.NewKeyGenerator(pp.params)
+	rtk := func(sk *bfv.SecretKey) *bfv.RotationKeySet {
+		return keyGen.GenRotationKeys(galEls, sk)
+	}
+	return newClientWithRotations(pp, keyGen, rtk)
+}
+
+func newClientWithRotations(pp *PSIParams, keyGen bfv.KeyGenerator, genRtk func(*bfv.SecretKey) *bfv.RotationKeySet) *Client {
+	sk, pk := keyGen.GenKeyPair()
+	rlk := keyGen.GenRelinearizationKey(sk, 2)
+	rtk := genRtk(sk)
+	evk := &bfv.EvaluationKey{
 		Rlk:  rlk,
 		Rtks: rtk,
 	}
 
+	return newClientFromKeys(pp, sk, pk, evk)
+}
+
+func newClientFromKeys(pp *PSIParams, sk *bfv.SecretKey, pk *bfv.PublicKey, evk *bfv.EvaluationKey) *Client {
+	params := pp.params
+	cl := &Client{
+		pp:  pp,
+		sk:  sk,
+		pk:  pk,
+		evk: evk,
+	}
+	cl.key = &ClientKey{pk: pk, evk: evk}
+
 	cl.encoder = bfv.NewEncoder(params)
 	cl.encryptor = bfv.NewEncryptorFromSk(params, cl.sk)
 	cl.decryptor = bfv.NewDecryptor(params, cl.sk)
@@ -46,65 +77,105 @@ func NewClient(pp *PSIParams) *client {
 	return cl
 }
 
-func (cl *client) GetKey() *clientKey {
-	key := clientKey{
-		pk:  cl.pk,
-		evk: cl.evk,
-	}
-	return &key
+func (cl *Client) GetKey() *ClientKey {
+	return cl.key
 }
 
-func (cl *client) Query(set []uint64, queryType QueryType) (*psiQuery, error) {
-	expandedSet := make([]uint64, cl.pp.params.N())
+func (cl *Client) Query(set []uint64, queryType QueryType) (*PsiQuery, error) {
+	return cl.query([][]uint64{set}, queryType)
+}
+
+// Only small domain queries pack several sets (see QueryBatch)
+func (cl *Client) query(sets [][]uint64, queryType QueryType) (*PsiQuery, error) {
+	if err := checkQuery(cl.pp, queryType); err != nil {
+		return nil, err
+	}
+	set := sets[0]
+	q := PsiQuery{
+		clientSetSize: len(set),
+		queryType:     queryType,
+	}
 
 	if queryType.IsSmallDomain {
-		// replicates the bit vector till it fills all the slots
+		// replicates the bit vectors till they fill all the slots
 		// sdBitVecLen is a power of 2
 		Logger.Info().Msgf("Create a small domain query.")
+		expandedSet := make([]uint64, cl.pp.params.N())
+		// The i-th block holds the (i mod PackedQueries)-th set, or an empty set
+		queryNum := queryType.queryNum()
 		for i := 0; i < int(cl.pp.params.N())/cl.pp.SdBitVecLen; i++ {
-			EncodeSetAsBitVector(set, expandedSet[i*cl.pp.SdBitVecLen:(i+1)*cl.pp.SdBitVecLen])
+			if i%queryNum < len(sets) {
+				EncodeSetAsBitVector(sets[i%queryNum], expandedSet[i*cl.pp.SdBitVecLen:(i+1)*cl.pp.SdBitVecLen])
+			}
 		}
+		q.ctxs = []*bfv.Ciphertext{cl.encryptSlots(expandedSet)}
 
 	} else {
 		// Large domain protocols
 		Logger.Info().Msgf("Create a large domain query.")
+		if err := cl.pp.checkServerBins(); err != nil {
+			return nil, err
+		}
+		if err := checkLargeDomainSet(cl.pp, set); err != nil {
+			return nil, err
+		}
 		Logger.Debug().Msgf("Max client size: %v, Max server size %v, Replica per ctx: %v.", cl.pp.MaxClientElemPerCtx, cl.pp.ClientPolyExpansion, cl.pp.ClRepNum)
 
-		if len(set) > cl.pp.MaxClientElemPerCtx {
-			return nil, errors.New("too many client elements in query")
+		// Sets larger than MaxClientElemPerCtx are split across several ciphertexts
+		q.ctxs = make([]*bfv.Ciphertext, cl.pp.queryCtxNum(len(set)))
+		for j := range q.ctxs {
+			chunk := set[j*cl.pp.MaxClientElemPerCtx:]
+			if len(chunk) > cl.pp.MaxClientElemPerCtx {
+				chunk = chunk[:cl.pp.MaxClientElemPerCtx]
+			}
+			q.ctxs[j] = cl.encryptSlots(cl.expandLargeDomainSet(chunk))
 		}
+		Logger.Debug().Msgf("Number of query ciphertexts: %v", len(q.ctxs))
+	}
 
-		// Polynomial replication
-		for rep := 0; rep < cl.pp.ClRepNum; rep++ {
-			for k := 0; k < len(set); k++ {
-				base := rep * cl.pp.MaxClientElemPerCtx / 2
-				base += k % (cl.pp.MaxClientElemPerCtx / 2)
-				base *= cl.pp.ClientPolyExpansion
-				if k >= (cl.pp.MaxClientElemPerCtx / 2) {
-					base += int(cl.pp.params.N()) / 2
-				}
+	return &q, nil
+}
 
-				expandedSet[base] = set[k]
-				for i := 1; i < cl.pp.ClientPolyExpansion; i++ {
-					expandedSet[base+i] = (expandedSet[base+i-1] * set[k]) % cl.pp.params.T()
-				}
+// Packs at most MaxClientElemPerCtx elements with their powers.
+// The replica of a bin only holds the elements of that bin (see ServerBins).
+func (cl *Client) expandLargeDomainSet(set []uint64) []uint64 {
+	expandedSet := make([]uint64, cl.pp.params.N())
+	bins := cl.pp.binSet(set)
+
+	// Polynomial replication
+	for rep := 0; rep < cl.pp.ClRepNum; rep++ {
+		bin := bins[rep%cl.pp.ServerBins]
+		for k := 0; k < len(bin); k++ {
+			base := largeDomainSlot(cl.pp, rep, k)
+			expandedSet[base] = bin[k]
+			for i := 1; i < cl.pp.ClientPolyExpansion; i++ {
+				expandedSet[base+i] = (expandedSet[base+i-1] * bin[k]) % cl.pp.params.T()
 			}
 		}
 	}
+	return expandedSet
+}
 
+func (cl *Client) encryptSlots(slots []uint64) *bfv.Ciphertext {
 	ptx := bfv.NewPlaintext(cl.pp.params)
-	cl.encoder.EncodeUint(expandedSet, ptx)
-	ctx := cl.encryptor.EncryptNew(ptx)
+	cl.encoder.EncodeUint(slots, ptx)
+	return cl.encryptor.EncryptNew(ptx)
+}
 
-	q := psiQuery{
-		clientSetSize: len(set),
-		ctx:           ctx,
-		queryType:     queryType,
+func (cl *Client) EvalResponse(clientSet []uint64, query *PsiQuery, resp *PsiResponse) []uint64 {
+	if query.queryType.queryNum() > 1 {
+		// Warning: For API compatibility, we only return the results of the first packed set.
+		// Use EvalBatchResponse to get the results of every packed set.
+		results, err := cl.EvalBatchResponse([][]uint64{clientSet}, query, resp)
+		if err != nil {
+			return nil
+		}
+		return results[0]
 	}
-	return &q, nil
+	return cl.evalResponse(clientSet, query, resp)
 }
 
-func (cl *client) EvalResponse(clientSet []uint64, query *psiQuery, resp *psiResponse) []uint64 {
+func (cl *Client) evalResponse(clientSet []uint64, query *PsiQuery, resp *PsiResponse) []uint64 {
 	Logger.Info().Msgf("client: evaluating the response")
 
 	qt := query.queryType
@@ -114,19 +185,47 @@ func (cl *client) EvalResponse(clientSet []uint64, query *psiQuery, resp *psiRes
 		Logger.Info().Msgf("client: simple psi layer without matching or aggregation.")
 
 		if qt.Psi == PSI_PSI {
-			intersections := make([][]uint64, len(resp.ctxs))
-			for k := 0; k < len(resp.ctxs); k++ {
-				respPtx := cl.decryptor.DecryptNew(resp.ctxs[k])
+			intersections, err := cl.EvalIntersections(clientSet, query, resp)
+			if err != nil || len(intersections) == 0 {
+				return nil
+			}
+			// Warning: For API compatibility, we only return the intersection with the first set since the output type is []uint64
+			// Use EvalIntersections to get the intersection with every server set.
+			return intersections[0]
+		} else if qt.Psi == PSI_CA && !qt.IsSmallDomain {
+			// Count the zero indicators of each set over all the query ciphertexts
+			ans := make([]uint64, resp.serverSetNum)
+			perQuery := len(resp.ctxs) / len(query.ctxs)
+			for i, ctx := range resp.ctxs {
+				respPtx := cl.decryptor.DecryptNew(ctx)
 				respData := cl.encoder.DecodeUintNew(respPtx)
-				intersections[k] = make([]uint64, 0, len(clientSet))
-				for i, v := range clientSet {
-					if respData[i*cl.pp.ClientPolyExpansion] == 0 {
-						intersections[k] = append(intersections[k], v)
+
+				// With bins, the empty positions of the query are not padded by the server
+				empty := uint64(0)
+				if cl.pp.ServerBins > 1 {
+					chunkSize := len(clientSet) - (i/perQuery)*cl.pp.MaxClientElemPerCtx
+					if chunkSize > cl.pp.MaxClientElemPerCtx {
+						chunkSize = cl.pp.MaxClientElemPerCtx
+					}
+					empty = uint64(cl.pp.ServerBins*cl.pp.MaxClientElemPerCtx - chunkSize)
+				}
+
+				for set := 0; set < cl.pp.ldSetsPerCtx; set++ {
+					n := (i%perQuery)*cl.pp.ldSetsPerCtx + set
+					if n >= resp.serverSetNum {
+						break
 					}
+					for rep := set * cl.pp.ServerBins; rep < (set+1)*cl.pp.ServerBins; rep++ {
+						for k := 0; k < cl.pp.MaxClientElemPerCtx; k++ {
+							if respData[largeDomainSlot(cl.pp, rep, k)] == 0 {
+								ans[n]++
+							}
+						}
+					}
+					ans[n] -= empty
 				}
 			}
-			// Warning: For API compatibility, we only return the intersection with the first set since the output type is []uint64
-			return intersections[0]
+			return ans
 		} else if qt.Psi == PSI_CA && qt.IsSmallDomain {
 			ans := make([]uint64, 0, resp.serverSetNum)
 			for _, ctx := range resp.ctxs {
@@ -146,14 +245,7 @@ func (cl *client) EvalResponse(clientSet []uint64, query *psiQuery, resp *psiRes
 	for _, ctx := range resp.ctxs {
 		respPtx := cl.decryptor.DecryptNew(ctx)
 		respData := cl.encoder.DecodeUintNew(respPtx)
-
-		if qt.Matching == MATCHING_FPSM {
-			respData = rearrangeFPSIResp(respData, cl.pp)
-		} else if qt.Matching == MATCHING_TVERSKY || qt.Matching == MATCHING_TVERSKY_PLAIN {
-			respData = rearrangeDecryptedBatchedCipher(cl.pp, respData, cl.pp.SdBitVecLen)
-		}
-
-		ans = append(ans, respData...)
+		ans = append(ans, rearrangeResp(cl.pp, qt, respData)...)
 	}
 	if len(ans) > resp.serverSetNum {
 		ans = ans[:resp.serverSetNum]
@@ -182,3 +274,58 @@ func (cl *client) EvalResponse(clientSet []uint64, query *psiQuery, resp *psiRes
 	}
 
 }
+
+// Slots of the response of a server set (in server order), see EvalResponse
+func rearrangeResp(pp *PSIParams, qt QueryType, data []uint64) []uint64 {
+	if qt.Matching == MATCHING_FPSM {
+		return rearrangeFPSIResp(data, pp)
+	} else if qt.Matching == MATCHING_TVERSKY || qt.Matching == MATCHING_TVERSKY_PLAIN || isBatchedSDMatching(qt.Matching) {
+		return rearrangeDecryptedBatchedCipher(pp, data, pp.SdBitVecLen)
+	}
+	return data
+}
+
+// EvalIntersections decodes the response of a PSI query (without matching and aggregation)
+// and returns the intersection of the client set with each server set, in server order.
+func (cl *Client) EvalIntersections(clientSet []uint64, query *PsiQuery, resp *PsiResponse) ([][]uint64, error) {
+	qt := query.queryType
+	if qt.Psi != PSI_PSI || qt.Matching != MATCHING_NONE || qt.Aggregation != AGGREGATION_NAIVE {
+		return nil, errors.New("intersections are only available for psi queries without matching and aggregation")
+	}
+	if qt.IsSmallDomain {
+		return cl.evalSmallDomainIntersections(clientSet, resp), nil
+	}
+
+	intersections := make([][]uint64, resp.serverSetNum)
+	for n := range intersections {
+		intersections[n] = make([]uint64, 0, len(clientSet))
+	}
+	// Responses to the query ciphertexts follow each other.
+	// Each ctx holds ClRepNum/ServerBins server sets, each set takes one replica per bin.
+	perQuery := len(resp.ctxs) / len(query.ctxs)
+	for i, ctx := range resp.ctxs {
+		respPtx := cl.decryptor.DecryptNew(ctx)
+		respData := cl.encoder.DecodeUintNew(respPtx)
+
+		chunk := clientSet[(i/perQuery)*cl.pp.MaxClientElemPerCtx:]
+		if len(chunk) > cl.pp.MaxClientElemPerCtx {
+			chunk = chunk[:cl.pp.MaxClientElemPerCtx]
+		}
+		for set := 0; set < cl.pp.ldSetsPerCtx; set++ {
+			n := (i%perQuery)*cl.pp.ldSetsPerCtx + set
+			if n >= resp.serverSetNum {
+				break
+			}
+			// Position of each element in the replica of its bin (see expandLargeDomainSet)
+			binSizes := make([]int, cl.pp.ServerBins)
+			for _, v := range chunk {
+				bin := cl.pp.serverBin(v)
+				if respData[largeDomainSlot(cl.pp, set*cl.pp.ServerBins+bin, binSizes[bin])] == 0 {
+					intersections[n] = append(intersections[n], v)
+				}
+				binSizes[bin]++
+			}
+		}
+	}
+	return intersections, nil
+}
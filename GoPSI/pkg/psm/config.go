@@ -4,4 +4,8 @@ var ENABLE_PROGRESS_BAR = true
 
 const SKIP_LONG_TESTS = true
 
-const MAX_TVERSKY_SCORE = 106
+// Default bound on the intersection cardinality of Tversky matches (range check in [0, 106))
+const TVERSKY_MAX_CARDINALITY = 105
+
+// Multiplicative depth of the x-ms aggregation of Tversky results
+const TVERSKY_X_MS_DEPTH = 6
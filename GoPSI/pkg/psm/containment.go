@@ -0,0 +1,72 @@
+package psm
+
+import (
+	"errors"
+)
+
+// Small domain f-psm compares the client bit vector X with the bit vector S of every server set:
+//   - MATCHING_FPSM_SUBSET:   X ⊆ S (e.g., substructure screening)
+//   - MATCHING_FPSM_SUPERSET: S ⊆ X
+//   - MATCHING_FPSM_EQUAL:    X = S
+//
+// Like tversky, the server evaluates a score a|X∩S| - b|X| - c|S| from the output of computePSI_CA_SD.
+// These scores are never positive and are zero iff the sets match, so the server randomizes them
+// multiplicatively instead of running a range check.
+
+func isSmallDomainFPSM(m MatchingType) bool {
+	return m == MATCHING_FPSM_SUBSET || m == MATCHING_FPSM_SUPERSET || m == MATCHING_FPSM_EQUAL
+}
+
+// Small domain matching layers whose batched results are zero iff the set matches (see randomizeBatchedResults)
+func isBatchedSDMatching(m MatchingType) bool {
+	return isSmallDomainFPSM(m) || isSimilarityMetric(m) || m == MATCHING_HAMMING
+}
+
+// Multiplicative depth of a small domain matching layer before the randomization of its results
+func batchedMatchingDepth(qt QueryType) int {
+	if isSimilarityMetric(qt.Matching) {
+		scoreLim, _ := similarityScoreLimit(qt.Matching, qt.Similarity)
+		return similarityDepth(qt, scoreLim)
+	} else if qt.Matching == MATCHING_HAMMING {
+		return hammingDepth(qt)
+	}
+	return 0
+}
+
+// Coefficients of the score of a small domain f-psm variant
+func sdFPSMCoefficients(m MatchingType) (a, b, c uint64) {
+	switch m {
+	case MATCHING_FPSM_SUBSET:
+		// |X∩S| - |X|
+		return 1, 1, 0
+	case MATCHING_FPSM_SUPERSET:
+		// |X∩S| - |S|
+		return 1, 0, 1
+	}
+	// (|X∩S| - |X|) + (|X∩S| - |S|)
+	return 2, 1, 1
+}
+
+// Small domain f-psm runs on small domain psi-ca, with naive, x-ms, or ca-ms aggregation.
+func checkSmallDomainFPSMQuery(qt QueryType) error {
+	if !isSmallDomainFPSM(qt.Matching) {
+		return nil
+	}
+	if !qt.IsSmallDomain {
+		return errors.New("subset, superset, and equality matching require the small domain")
+	}
+	if qt.Psi != PSI_CA {
+		return errors.New("subset, superset, and equality matching require psi-ca")
+	}
+	if qt.Aggregation != AGGREGATION_NAIVE && qt.Aggregation != AGGREGATION_X_MS && qt.Aggregation != AGGREGATION_CA_MS {
+		return errors.New("subset, superset, and equality matching support naive, x-ms, and ca-ms aggregation")
+	}
+	return nil
+}
+
+// PlainFPSM reports whether the client set matches a server set with the small domain f-psm variant m.
+func PlainFPSM(m MatchingType, client []uint64, server []uint64) bool {
+	a, b, c := sdFPSMCoefficients(m)
+	I := Intersection(client, server)
+	return int(a)*len(I) == int(b)*len(client)+int(c)*len(server)
+}
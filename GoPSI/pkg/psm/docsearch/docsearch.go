@@ -0,0 +1,226 @@
+// Package docsearch implements private keyword search over text documents on top of the
+// large domain psi with f-psm matching: a document matches a query if it contains all the
+// query keywords.
+package docsearch
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/spring-epfl/private-collection-matching/pkg/psm"
+)
+
+// Config of the keyword encoding. Client and server must use the same configuration.
+type Config struct {
+	// Key of the element encoding (see psm.ElementEncoder)
+	Key []byte
+	// Number of hash functions applied to each keyword. A document falsely matches a keyword
+	// only if all the hashes collide, which reduces the false-positive rate exponentially.
+	HashPerKeyword int
+}
+
+func DefaultConfig(key []byte) Config {
+	return Config{Key: key, HashPerKeyword: 2}
+}
+
+type Document struct {
+	ID   string
+	Text string
+}
+
+// Tokenize splits a text into lower-case keywords made of letters and digits.
+// Duplicates are removed, the order of the first occurrences is kept.
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]bool, len(words))
+	keywords := make([]string, 0, len(words))
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			keywords = append(keywords, w)
+		}
+	}
+	return keywords
+}
+
+type keywordEncoder struct {
+	enc            *psm.ElementEncoder
+	hashPerKeyword int
+}
+
+func newKeywordEncoder(pp *psm.PSIParams, cfg Config) (*keywordEncoder, error) {
+	if cfg.HashPerKeyword < 1 {
+		return nil, errors.New("docsearch: at least one hash per keyword is required")
+	}
+	return &keywordEncoder{
+		enc:            psm.NewElementEncoder(pp, cfg.Key),
+		hashPerKeyword: cfg.HashPerKeyword,
+	}, nil
+}
+
+// Each keyword becomes HashPerKeyword elements, the i-th hash prefixes the keyword with i.
+func (ke *keywordEncoder) encode(keywords []string) []uint64 {
+	set := make([]uint64, 0, len(keywords)*ke.hashPerKeyword)
+	buff := make([]byte, 0, 64)
+	for _, kw := range keywords {
+		for i := 0; i < ke.hashPerKeyword; i++ {
+			buff = append(append(buff[:0], byte(i)), kw...)
+			set = append(set, ke.enc.EncodeBytes(buff))
+		}
+	}
+	return set
+}
+
+// EncodeKeywords normalizes the keywords (see Tokenize) and encodes them as a large domain set.
+func EncodeKeywords(pp *psm.PSIParams, cfg Config, keywords []string) ([]uint64, error) {
+	ke, err := newKeywordEncoder(pp, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ke.encode(Tokenize(strings.Join(keywords, " "))), nil
+}
+
+// ReadCorpus reads the regular files of a directory as documents identified by their file names.
+func ReadCorpus(dir string) ([]Document, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]Document, 0, len(files))
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		text, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, Document{ID: f.Name(), Text: string(text)})
+	}
+	return docs, nil
+}
+
+// Index is the server side of the search: the encoded keywords of a document collection.
+type Index struct {
+	ids  []string
+	sets [][]uint64
+	sv   *psm.Server
+}
+
+func NewIndex(pp *psm.PSIParams, cfg Config, docs []Document) (*Index, error) {
+	ke, err := newKeywordEncoder(pp, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{
+		ids:  make([]string, len(docs)),
+		sets: make([][]uint64, len(docs)),
+	}
+	for i, doc := range docs {
+		idx.ids[i] = doc.ID
+		idx.sets[i] = ke.encode(Tokenize(doc.Text))
+	}
+	if idx.sv, err = psm.NewServer(pp, idx.sets); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// IDs returns the document identifiers in the order of the search results.
+// The client needs them to map results back to documents.
+func (idx *Index) IDs() []string {
+	return idx.ids
+}
+
+// Sets returns the encoded keyword set of each document.
+func (idx *Index) Sets() [][]uint64 {
+	return idx.sets
+}
+
+func (idx *Index) Server() *psm.Server {
+	return idx.sv
+}
+
+func (idx *Index) Respond(query *Query, key *psm.ClientKey) (*psm.PsiResponse, error) {
+	return idx.sv.Respond(query.PsiQuery, key)
+}
+
+// Searcher is the client side of the search.
+type Searcher struct {
+	cl *psm.Client
+	ke *keywordEncoder
+	qt psm.QueryType
+}
+
+func NewSearcher(pp *psm.PSIParams, cl *psm.Client, cfg Config) (*Searcher, error) {
+	ke, err := newKeywordEncoder(pp, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Searcher{cl: cl, ke: ke, qt: QueryType()}, nil
+}
+
+// QueryType returns the type of the search queries, e.g., to generate the client keys
+// with psm.NewClientFor.
+func QueryType() psm.QueryType {
+	qt, _ := psm.NewQueryType(false, psm.PSI_PSI, psm.MATCHING_FPSM, psm.AGGREGATION_NAIVE)
+	return *qt
+}
+
+// Query is a search query with the encoded keywords needed to evaluate the response.
+type Query struct {
+	*psm.PsiQuery
+	set []uint64
+}
+
+// Query creates a query for the documents containing all the keywords.
+// Keywords are normalized like the documents (see Tokenize).
+func (s *Searcher) Query(keywords []string) (*Query, error) {
+	keywords = Tokenize(strings.Join(keywords, " "))
+	if len(keywords) == 0 {
+		return nil, errors.New("docsearch: empty query")
+	}
+	set := s.ke.encode(keywords)
+	query, err := s.cl.Query(set, s.qt)
+	if err != nil {
+		return nil, err
+	}
+	return &Query{PsiQuery: query, set: set}, nil
+}
+
+// Results returns the identifiers of the matching documents, given the identifiers of all
+// the documents of the index in order (see Index.IDs).
+func (s *Searcher) Results(query *Query, resp *psm.PsiResponse, ids []string) ([]string, error) {
+	matches := s.cl.EvalResponse(query.set, query.PsiQuery, resp)
+	if len(matches) != len(ids) {
+		return nil, fmt.Errorf("docsearch: %v results for %v documents", len(matches), len(ids))
+	}
+	out := make([]string, 0)
+	for i, match := range matches {
+		if match == 1 {
+			out = append(out, ids[i])
+		}
+	}
+	return out, nil
+}
+
+// Search runs a query against a local index.
+func (s *Searcher) Search(idx *Index, keywords []string) ([]string, error) {
+	query, err := s.Query(keywords)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := idx.Respond(query, s.cl.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	return s.Results(query, resp, idx.IDs())
+}
@@ -0,0 +1,67 @@
+package docsearch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spring-epfl/private-collection-matching/pkg/psm"
+)
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("Private  set-intersection, PRIVATE matching; 2 sets!")
+	expected := []string{"private", "set", "intersection", "matching", "2", "sets"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	pp := psm.NewPSIParams(psm.GetBFVParam(13), 128)
+	pp.MaxClientElemPerCtx = 8
+	pp.ClRepNum = 4
+	pp.Update()
+	psm.ENABLE_PROGRESS_BAR = false
+
+	cfg := DefaultConfig([]byte("corpus key"))
+	docs := []Document{
+		{"bfv.txt", "The BFV scheme supports SIMD operations on encrypted vectors."},
+		{"psi.txt", "Private set intersection with homomorphic encryption: the server evaluates a polynomial."},
+		{"pcm.txt", "Private collection matching extends private set intersection to collections of sets."},
+		{"empty.txt", ""},
+		{"go.txt", "Go is a programming language."},
+	}
+	idx, err := NewIndex(pp, cfg, docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	searcher, err := NewSearcher(pp, psm.NewClientFor(pp, QueryType()), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		keywords []string
+		expected []string
+	}{
+		{[]string{"private", "intersection"}, []string{"psi.txt", "pcm.txt"}},
+		{[]string{"Private Set Intersection"}, []string{"psi.txt", "pcm.txt"}},
+		{[]string{"collections", "PRIVATE"}, []string{"pcm.txt"}},
+		{[]string{"encrypted", "polynomial"}, []string{}},
+		// Multi-ciphertext query: 5 keywords, 2 hashes each
+		{[]string{"private", "set", "intersection", "the", "server"}, []string{"psi.txt"}},
+	}
+	for _, tc := range cases {
+		got, err := searcher.Search(idx, tc.keywords)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%v: got %v, expected %v", tc.keywords, got, tc.expected)
+		}
+	}
+
+	if _, err := searcher.Search(idx, []string{" ,;"}); err == nil {
+		t.Error("searching without keywords must fail")
+	}
+}
@@ -0,0 +1,91 @@
+package psm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Domain separation tags of the element types
+const (
+	elementTagBytes byte = iota + 1
+	elementTagID
+)
+
+// ElementEncoder maps arbitrary elements (strings, byte slices, 64-bit IDs) to large domain
+// elements, i.e., non-zero values of the plaintext field [1, T).
+//
+// Elements are hashed with HMAC-SHA256 under a key shared by the client and the server.
+// Distinct elements collide with probability 1/(T-1), so a server set of m elements
+// matches a client element that it does not contain with probability at most m/(T-1)
+// (see FalsePositiveRate).
+type ElementEncoder struct {
+	key []byte
+	T   uint64
+}
+
+func NewElementEncoder(pp *PSIParams, key []byte) *ElementEncoder {
+	return &ElementEncoder{
+		key: append([]byte{}, key...),
+		T:   pp.params.T(),
+	}
+}
+
+func (enc *ElementEncoder) encode(tag byte, data []byte) uint64 {
+	mac := hmac.New(sha256.New, enc.key)
+	mac.Write([]byte{tag})
+	mac.Write(data)
+	digest := mac.Sum(nil)
+	// The bias of the reduction is at most T/2^64
+	return binary.BigEndian.Uint64(digest[:8])%(enc.T-1) + 1
+}
+
+func (enc *ElementEncoder) EncodeBytes(x []byte) uint64 {
+	return enc.encode(elementTagBytes, x)
+}
+
+func (enc *ElementEncoder) EncodeString(x string) uint64 {
+	return enc.encode(elementTagBytes, []byte(x))
+}
+
+func (enc *ElementEncoder) EncodeID(x uint64) uint64 {
+	var buff [8]byte
+	binary.BigEndian.PutUint64(buff[:], x)
+	return enc.encode(elementTagID, buff[:])
+}
+
+// EncodeStrings encodes a set of strings. The i-th output encodes the i-th input,
+// so intersections can be mapped back to the original elements.
+func (enc *ElementEncoder) EncodeStrings(xs []string) []uint64 {
+	out := make([]uint64, len(xs))
+	for i, x := range xs {
+		out[i] = enc.EncodeString(x)
+	}
+	return out
+}
+
+func (enc *ElementEncoder) EncodeIDs(xs []uint64) []uint64 {
+	out := make([]uint64, len(xs))
+	for i, x := range xs {
+		out[i] = enc.EncodeID(x)
+	}
+	return out
+}
+
+// FalsePositiveRate bounds the probability that a server set with serverSetSize elements
+// reports at least one of clientSetSize client elements it does not contain (union bound).
+func (enc *ElementEncoder) FalsePositiveRate(clientSetSize, serverSetSize int) float64 {
+	return float64(clientSetSize) * float64(serverSetSize) / float64(enc.T-1)
+}
+
+// Large domain elements must be non-zero (zero is a root of every server polynomial)
+// and smaller than T (elements are interpolated modulo T).
+func checkLargeDomainSet(pp *PSIParams, set []uint64) error {
+	for _, x := range set {
+		if x == 0 || x >= pp.params.T() {
+			return fmt.Errorf("large domain element %v is not in [1, %v), see ElementEncoder", x, pp.params.T())
+		}
+	}
+	return nil
+}
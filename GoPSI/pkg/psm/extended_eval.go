@@ -1,7 +1,8 @@
 package psm
 
 import (
-	"errors"
+	"fmt"
+	"math/bits"
 
 	"github.com/ldsec/lattigo/v2/bfv"
 )
@@ -147,9 +148,8 @@ func IsInRange(pp *PSIParams, evaluator bfv.Evaluator, ctx *bfv.Ciphertext, n in
 func ExtendedRotate(pp *PSIParams, evaluator bfv.Evaluator, ctx *bfv.Ciphertext, rot int) *bfv.Ciphertext {
 	ans := ctx.CopyNew().Ciphertext()
 
-	if rot < 0 {
-		rot += int(pp.params.N() / 2)
-	}
+	// columns rotations are cyclic in each row
+	rot = int(Mod(rot, int(pp.params.N()/2)))
 
 	for k := 1; rot > 0; k *= 2 {
 		if rot%2 == 1 {
@@ -161,34 +161,71 @@ func ExtendedRotate(pp *PSIParams, evaluator bfv.Evaluator, ctx *bfv.Ciphertext,
 	return ans
 }
 
-// Perform element-wise power ^n
+// Perform element-wise power ^n with square-and-multiply (depth: see powDepth)
+// The product of the odd powers is relinearized lazily: only when it reaches degree 3
+// (the highest degree of the relinearization key of the client) and at the end.
 func Pow(evaluator bfv.Evaluator, x *bfv.Ciphertext, n int) (*bfv.Ciphertext, error) {
-	if n == 0 {
-		return nil, errors.New("cannot perform power(x, 0)")
+	if n < 1 {
+		return nil, fmt.Errorf("cannot perform power(x, %v)", n)
 	}
 
-	if n == 1 {
-		return x, nil
+	var res *bfv.Ciphertext
+	square := x
+	for {
+		if n%2 == 1 {
+			if res == nil {
+				res = square
+			} else {
+				res = evaluator.MulNew(res, square)
+				if res.Degree() > 2 {
+					evaluator.Relinearize(res, res)
+				}
+			}
+		}
+		n /= 2
+		if n == 0 {
+			break
+		}
+		square = evaluator.MulNew(square, square)
+		evaluator.Relinearize(square, square)
 	}
 
-	xsquare := evaluator.MulNew(x, x)
-	evaluator.Relinearize(xsquare, xsquare)
-	if n%2 == 0 {
-		var pow, err = Pow(evaluator, xsquare, n/2)
-		return pow, err
-	} else {
-		var pow, err = Pow(evaluator, xsquare, (n-1)/2)
-		if err != nil {
-			return nil, err
-		}
-		res := evaluator.MulNew(x, pow)
-		evaluator.Relinearize(res, res)
-		return res, nil
+	if res.Degree() > 1 {
+		res = evaluator.RelinearizeNew(res)
+	}
+	return res, nil
+}
+
+// Multiplicative depth of Pow(x, n): one level per squaring, and one for the products of the odd powers
+func powDepth(n int) int {
+	depth := bits.Len(uint(n)) - 1
+	if bits.OnesCount(uint(n)) > 1 {
+		depth++
+	}
+	return depth
+}
+
+// IsZero computes c[i] == 0 as 1 - c[i]^(T-1) (Fermat's little theorem).
+// Requires depth powDepth(T-1), e.g., with GetFermatBFVParam.
+func IsZero(pp *PSIParams, evaluator bfv.Evaluator, x *bfv.Ciphertext) (*bfv.Ciphertext, error) {
+	T := pp.params.T()
+	depth := powDepth(int(T - 1))
+	if maxDepth := pp.MaxDepth(); maxDepth >= 0 && depth > maxDepth {
+		return nil, fmt.Errorf("IsZero requires depth %v but the parameters only support %v (see GetFermatBFVParam)", depth, maxDepth)
+	}
+
+	pow, err := Pow(evaluator, x, int(T-1))
+	if err != nil {
+		return nil, err
 	}
+	out := evaluator.NegNew(pow)
+	evaluator.Add(out, pp.rangePtxs[1], out)
+	return out, nil
 }
 
-func IsZero(evaluator bfv.Evaluator, x *bfv.Ciphertext) (*bfv.Ciphertext, error) {
-	return nil, errors.New("IsZero requires depth incompatible with batching")
+// IsEqual computes c0[i] == c1[i], see IsZero
+func IsEqual(pp *PSIParams, evaluator bfv.Evaluator, ctx0, ctx1 *bfv.Ciphertext) (*bfv.Ciphertext, error) {
+	return IsZero(pp, evaluator, evaluator.SubNew(ctx0, ctx1))
 }
 
 //////////////////////////////////
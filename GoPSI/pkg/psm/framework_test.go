@@ -1,8 +1,15 @@
 package psm
 
 import (
+	"fmt"
+	"math/big"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
 )
 
 const PARAM_SIZE = 15
@@ -37,6 +44,29 @@ func runHomoPsi(paramSize int, clientSet []uint64, serverSets [][]uint64, qt Que
 	return pp, ans
 }
 
+// Large domain sets: a client set of 5 elements and setNum server sets of 10 to 60 elements,
+// the third of which shares 4 elements with the client set.
+func largeDomainSets(setNum int) ([]uint64, [][]uint64) {
+	sets, err := RandomDataSet(setNum+1, 10, 60, 200)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, serverSets := sets[0][:5], sets[1:]
+	serverSets[2] = append(serverSets[2][:10], clientSet[:4]...)
+	return clientSet, serverSets
+}
+
+func checkCardinalityResult(t *testing.T, clientSet []uint64, serverSets [][]uint64, ans []uint64) {
+	if len(ans) != len(serverSets) {
+		t.Fatalf("expected %v cardinalities, got %v", len(serverSets), len(ans))
+	}
+	for i, set := range serverSets {
+		if ans[i] != uint64(len(Intersection(clientSet, set))) {
+			t.Errorf("Set %v: cardinality %v, expected %v", i, ans[i], len(Intersection(clientSet, set)))
+		}
+	}
+}
+
 func checkPlainTversky(paramSize int, clientSet []uint64, serverSets [][]uint64) bool {
 	Logger.Debug().Msgf("running check plain tversky")
 
@@ -133,6 +163,9 @@ func Example() {
     // 1st positional parameters (small domain): false (use small input), true (use small domain)
     // psi layer: PSI_PS, PSI_CA
     // Matching layer: MATCHING_NONE, MATCHING_TVERSKY, MATCHING_TVERSKY_PLAIN, MATCHING_FPSM
+    //   small domain f-psm: MATCHING_FPSM_SUBSET, MATCHING_FPSM_SUPERSET, MATCHING_FPSM_EQUAL
+    //   similarity metrics: MATCHING_JACCARD, MATCHING_DICE, MATCHING_COSINE, MATCHING_OVERLAP
+    //   small domain near duplicates: MATCHING_HAMMING
     // Aggregation layer: AGGREGATION_NAIVE, AGGREGATION_X_MS, AGGREGATION_CA_MS
     // Check 'types.go' for more information.
     queryType, err := NewQueryType(true, PSI_CA, MATCHING_TVERSKY, AGGREGATION_NAIVE)
@@ -319,3 +352,1773 @@ func TestFPSMRandomLong(t *testing.T) {
 }
 
 // Currently no test for aggregation ca-ms or x-ms
+
+func TestWireRoundTrip(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestWireRoundTrip")
+
+	sets, err := RandomDataSet(40, 3, 100, 255)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, serverSets := sets[0], sets[1:]
+
+	qt, err := NewQueryType(true, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	cl := NewClient(pp)
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+
+	// client -> server
+	keyData, err := cl.GetKey().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := cl.Query(clientSet, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryData, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svKey, err := UnmarshalClientKey(keyData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svQuery, err := UnmarshalQuery(queryData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svQuery.queryType != *qt || svQuery.clientSetSize != len(clientSet) {
+		t.Fatalf("query metadata mismatch: %v, %v", svQuery.queryType, svQuery.clientSetSize)
+	}
+	if err := svQuery.CheckQuery(pp); err != nil {
+		t.Fatal(err)
+	}
+
+	// server -> client
+	resp, err := sv.Respond(svQuery, svKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respData, err := resp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clResp, err := UnmarshalResponse(respData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clResp.serverSetNum != len(serverSets) {
+		t.Fatalf("response set number mismatch: %v", clResp.serverSetNum)
+	}
+
+	ans := cl.EvalResponse(clientSet, query, clResp)
+	checkCardinalityResult(t, clientSet, serverSets, ans)
+
+	// Similarity metrics carry their own parameters, and not the Tversky weights
+	jaccard := *query
+	jaccard.queryType.Matching = MATCHING_JACCARD
+	jaccard.queryType.Similarity = SimilarityParams{Threshold: 0.6, MaxCardinality: 12}
+	jaccard.queryType.Tversky.Alpha = 0.5
+	data, err := jaccard.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := UnmarshalQuery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := jaccard.queryType
+	expected.Tversky = DefaultTverskyParams()
+	if received.queryType != expected {
+		t.Errorf("similarity query type %+v, expected %+v", received.queryType, expected)
+	}
+
+	// malformed inputs
+	if _, err := UnmarshalQuery(respData); err == nil {
+		t.Error("decoding a response as a query must fail")
+	}
+	if _, err := UnmarshalResponse(respData[:len(respData)-1]); err == nil {
+		t.Error("decoding a truncated response must fail")
+	}
+	queryData[1]++
+	if _, err := UnmarshalQuery(queryData); err == nil {
+		t.Error("decoding an unknown version must fail")
+	}
+	queryData[1] = 1
+	if _, err := UnmarshalQuery(queryData); err == nil {
+		t.Error("decoding the first version must fail")
+	}
+	queryData[1] = WIRE_FORMAT_VERSION
+	queryData[4] = 0xff
+	if _, err := UnmarshalQuery(queryData); err == nil {
+		t.Error("decoding an unknown matching must fail")
+	}
+
+	// Ciphertexts that decode but do not match the parameters
+	other, err := NewClient(NewPSIParams(GetBFVParam(12), 128)).Query(clientSet, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := *query
+	truncated.ctxs = []*bfv.Ciphertext{query.ctxs[0].CopyNew().Ciphertext()}
+	poly := truncated.ctxs[0].Value()[1]
+	poly.Coeffs[0] = poly.Coeffs[0][:len(poly.Coeffs[0])/2]
+	unreduced := *query
+	unreduced.ctxs = []*bfv.Ciphertext{query.ctxs[0].CopyNew().Ciphertext()}
+	unreduced.ctxs[0].Value()[0].Coeffs[0][0] = pp.params.Qi()[0]
+	for name, malformed := range map[string]*PsiQuery{"other parameters": other, "truncated": &truncated, "unreduced": &unreduced} {
+		data, err := malformed.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := UnmarshalQuery(data)
+		if err != nil {
+			continue
+		}
+		if err := received.CheckQuery(pp); err == nil {
+			t.Errorf("checking a query with a %v ciphertext must fail", name)
+		}
+		if _, err := sv.Respond(received, svKey); err == nil {
+			t.Errorf("answering a query with a %v ciphertext must fail", name)
+		}
+	}
+}
+
+func TestParallelRespond(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestParallelRespond")
+
+	sets, err := RandomDataSet(200, 3, 100, 167)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, serverSets := sets[0], sets[1:]
+
+	qt, err := NewQueryType(true, PSI_CA, MATCHING_TVERSKY_PLAIN, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+
+	pp := NewPSIParams(GetBFVParam(14), 128)
+	cl := NewClient(pp)
+	query, err := cl.Query(clientSet, *qt)
+	if err != nil {
+		panic(err)
+	}
+
+	var answers [][]uint64
+	for _, workers := range []int{1, 4} {
+		sv, err := NewServer(pp, serverSets, WithWorkers(workers))
+		if err != nil {
+			panic(err)
+		}
+		resp, err := sv.Respond(query, cl.GetKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers = append(answers, cl.EvalResponse(clientSet, query, resp))
+
+		// A panic of an evaluation comes back as an error instead of crashing the server
+		err = sv.newSession(cl.GetKey()).parallelFor(8, func(evaluator bfv.Evaluator, encoder bfv.Encoder, i int) error {
+			if i == 5 {
+				panic("index out of range")
+			}
+			return nil
+		})
+		if err == nil {
+			t.Errorf("%v workers: a panicking evaluation must return an error", workers)
+		}
+	}
+
+	if !reflect.DeepEqual(answers[0], answers[1]) {
+		t.Error("Mismatch between sequential and parallel evaluation")
+	}
+}
+
+func TestLargeDomainCardinality(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestLargeDomainCardinality")
+
+	clientSet, serverSets := largeDomainSets(29)
+	serverSets[7] = []uint64{}
+
+	qt, err := NewQueryType(false, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, repNum := range []int{1, 4} {
+		_, ans := runHomoPsi(13, clientSet, serverSets, *qt, repNum)
+		checkCardinalityResult(t, clientSet, serverSets, ans)
+	}
+}
+
+func TestTverskyCoefficients(t *testing.T) {
+	cases := []struct {
+		tp      TverskyParams
+		a, b, c uint64
+	}{
+		{DefaultTverskyParams(), 9, 4, 4},
+		{TverskyParams{Alpha: 1, Beta: 1, Threshold: 0.7}, 17, 7, 7},
+		{TverskyParams{Alpha: 1, Beta: 1, Threshold: 0.9}, 19, 9, 9},
+		{TverskyParams{Alpha: 1, Beta: 0, Threshold: 0.9}, 10, 9, 0},
+		{TverskyParams{Alpha: 0.5, Beta: 0.5, Threshold: 1}, 2, 1, 1},
+	}
+	for _, tc := range cases {
+		a, b, c, err := tc.tp.Coefficients()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != tc.a || b != tc.b || c != tc.c {
+			t.Errorf("%+v: got (%v, %v, %v), expected (%v, %v, %v)", tc.tp, a, b, c, tc.a, tc.b, tc.c)
+		}
+	}
+
+	if _, _, _, err := (TverskyParams{Alpha: 1, Beta: 1, Threshold: 0}).Coefficients(); err == nil {
+		t.Error("threshold 0 must be rejected")
+	}
+	if scoreLim, _ := DefaultTverskyParams().ScoreLimit(); scoreLim != 106 {
+		t.Errorf("default score limit %v, expected 106", scoreLim)
+	}
+
+	// depth check
+	pp := NewPSIParams(GetBFVParam(14), 128)
+	qt, _ := NewQueryType(true, PSI_CA, MATCHING_TVERSKY, AGGREGATION_X_MS)
+	if err := checkQuery(pp, *qt); err == nil {
+		t.Error("x-ms tversky must not fit the depth of P_16k")
+	}
+}
+
+func TestTverskyCustomThreshold(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestTverskyCustomThreshold")
+
+	sets, err := RandomDataSet(200, 3, 60, 167)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, serverSets := sets[0], sets[1:]
+	serverSets[10] = append([]uint64{}, clientSet...)
+	serverSets[20] = append(append([]uint64{}, clientSet[1:]...), 166)
+
+	tp := TverskyParams{Alpha: 1, Beta: 0.5, Threshold: 0.9, MaxCardinality: 63}
+
+	qt, err := NewQueryType(true, PSI_CA, MATCHING_TVERSKY, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	qt.Tversky = tp
+
+	_, ans := runHomoPsi(PARAM_SIZE, clientSet, serverSets, *qt, 1)
+
+	for i, set := range serverSets {
+		match := uint64(0)
+		if tp.Score(clientSet, set) >= 0 {
+			match = 1
+		}
+		if ans[i] != match {
+			t.Errorf("Set %v: match %v, expected %v (score %v)", i, ans[i], match, tp.Score(clientSet, set))
+		}
+	}
+}
+
+func TestMultiSetIntersections(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestMultiSetIntersections")
+
+	sets, err := RandomDataSet(12, 3, 60, 300)
+	if err != nil {
+		panic(err)
+	}
+	// The client set spans both rows of the ciphertext
+	clientSet, serverSets := []uint64{3, 5, 8, 13, 21, 34, 55, 89, 144, 233}, sets
+	serverSets[2] = append(serverSets[2][:3], 5, 89, 233)
+	serverSets[9] = append(serverSets[9][:3], clientSet...)
+
+	qt, err := NewQueryType(false, PSI_PSI, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, repNum := range []int{1, 4} {
+		pp := NewPSIParams(GetBFVParam(13), 128)
+		pp.ClRepNum = repNum
+		pp.Update()
+
+		cl := NewClient(pp)
+		sv, err := NewServer(pp, serverSets)
+		if err != nil {
+			panic(err)
+		}
+		query, err := cl.Query(clientSet, *qt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := sv.Respond(query, cl.GetKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		intersections, err := cl.EvalIntersections(clientSet, query, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(intersections) != len(serverSets) {
+			t.Fatalf("expected %v intersections, got %v", len(serverSets), len(intersections))
+		}
+		for i, set := range serverSets {
+			if len(intersections[i]) != len(Intersection(clientSet, set)) || (len(intersections[i]) > 0 && !reflect.DeepEqual(intersections[i], Intersection(clientSet, set))) {
+				t.Errorf("Set %v (rep %v): intersection %v, expected %v", i, repNum, intersections[i], Intersection(clientSet, set))
+			}
+		}
+	}
+}
+
+func TestRandomSource(t *testing.T) {
+	defer func(src RandomSource) { RandSource = src }(RandSource)
+
+	RandSource = NewSeededSource(42)
+	v1 := GenRandomVector(1000, 7, false)
+	RandSource = NewSeededSource(42)
+	v2 := GenRandomVector(1000, 7, false)
+	if !reflect.DeepEqual(v1, v2) {
+		t.Error("seeded sources must be deterministic")
+	}
+
+	RandSource = NewCryptoSource()
+	seen := make(map[uint64]bool)
+	for _, v := range GenRandomVector(1000, 7, false) {
+		if v == 0 || v >= 7 {
+			t.Fatalf("non-zero random value out of range: %v", v)
+		}
+		seen[v] = true
+	}
+	if len(seen) != 6 {
+		t.Errorf("expected all values of [1, 7), got %v", seen)
+	}
+
+	perm := randPerm(100)
+	hit := make([]bool, 100)
+	for _, p := range perm {
+		hit[p] = true
+	}
+	for i, h := range hit {
+		if !h {
+			t.Fatalf("%v is missing from the permutation", i)
+		}
+	}
+}
+
+func TestSaveLoadKeys(t *testing.T) {
+	pp := NewPSIParams(GetBFVParam(12), 2)
+	cl := NewClient(pp)
+	id, err := cl.GetKey().ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, passphrase := range []string{"", "correct horse battery staple"} {
+		data, err := cl.SaveKeys(passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadClient(pp, data, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loadedID, _ := loaded.GetKey().ID(); loadedID != id {
+			t.Errorf("key id changed after loading: %v, expected %v", loadedID, id)
+		}
+
+		// The restored client decrypts ciphertexts of the original one
+		query, err := cl.Query([]uint64{7, 11}, QueryType{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cl.encoder.DecodeUintNew(cl.decryptor.DecryptNew(query.ctxs[0])),
+			loaded.encoder.DecodeUintNew(loaded.decryptor.DecryptNew(query.ctxs[0]))) {
+			t.Error("restored client cannot decrypt")
+		}
+
+		if passphrase != "" {
+			if _, err := LoadClient(pp, data, "wrong"); err == nil {
+				t.Error("loading with a wrong passphrase must fail")
+			}
+			if _, err := LoadClient(pp, data, ""); err == nil {
+				t.Error("loading encrypted keys without a passphrase must fail")
+			}
+		} else if _, err := LoadClient(pp, data, "unused"); err == nil {
+			t.Error("loading unencrypted keys with a passphrase must fail")
+		}
+		if _, err := LoadClient(NewPSIParams(GetBFVParam(13), 2), data, passphrase); err == nil {
+			t.Error("loading keys with different parameters must fail")
+		}
+	}
+}
+
+func TestRotationPlanner(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestRotationPlanner")
+
+	clientSet, serverSets := largeDomainSets(9)
+
+	qt, err := NewQueryType(false, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	pp.ClRepNum = 4
+	pp.Update()
+
+	cl := NewClientFor(pp, *qt)
+	if planned, full := len(cl.evk.Rtks.Keys), len(NewClient(pp).evk.Rtks.Keys); planned >= full {
+		t.Errorf("planned client has %v rotation keys, full client has %v", planned, full)
+	}
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+	query, err := cl.Query(clientSet, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sv.Respond(query, cl.GetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ans := cl.EvalResponse(clientSet, query, resp)
+	checkCardinalityResult(t, clientSet, serverSets, ans)
+
+	// A key lacking a required rotation is rejected instead of failing during evaluation
+	delete(cl.evk.Rtks.Keys, pp.params.GaloisElementForRowRotation())
+	if _, err := sv.Respond(query, cl.GetKey()); err == nil {
+		t.Error("responding with an incomplete key must fail")
+	}
+}
+
+// Answers every query type with a client that only has the planned rotation keys:
+// a rotation missing from the plan makes the evaluator panic.
+func TestRotationPlanCoverage(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestRotationPlanCoverage")
+
+	sets, err := RandomDataSet(20, 3, 30, 200)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, serverSets := sets[0][:5], sets[1:]
+
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+	full := len(NewClient(pp).evk.Rtks.Keys)
+
+	queryTypes := []QueryType{
+		{IsSmallDomain: true, Psi: PSI_CA},
+		{IsSmallDomain: true, Psi: PSI_PSI},
+		{IsSmallDomain: true, Psi: PSI_CA, Matching: MATCHING_TVERSKY_PLAIN, Tversky: DefaultTverskyParams()},
+		{IsSmallDomain: true, Psi: PSI_CA, Matching: MATCHING_FPSM_SUBSET},
+		{IsSmallDomain: true, Psi: PSI_CA, Matching: MATCHING_FPSM_SUBSET, Aggregation: AGGREGATION_CA_MS},
+		{IsSmallDomain: true, Psi: PSI_CA, Matching: MATCHING_HAMMING, HammingRadius: 1},
+		{IsSmallDomain: true, Psi: PSI_CA, PackedQueries: 2},
+		{Psi: PSI_CA},
+		{Psi: PSI_PSI},
+		{Psi: PSI_PSI, Matching: MATCHING_FPSM},
+		{Psi: PSI_PSI, Matching: MATCHING_FPSM, Aggregation: AGGREGATION_CA_MS},
+	}
+	for _, qt := range queryTypes {
+		cl := NewClientFor(pp, qt)
+		if planned := len(cl.evk.Rtks.Keys); planned >= full {
+			t.Errorf("%+v: planned client has %v rotation keys, full client has %v", qt, planned, full)
+		}
+		query, err := cl.Query(clientSet, qt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := func() (resp *PsiResponse, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("the server uses a rotation missing from the plan: %v", r)
+				}
+			}()
+			return sv.Respond(query, cl.GetKey())
+		}()
+		if err != nil {
+			t.Errorf("%+v: %v", qt, err)
+			continue
+		}
+		if qt.Matching == MATCHING_NONE && qt.Psi == PSI_CA && qt.PackedQueries == 0 {
+			checkCardinalityResult(t, clientSet, serverSets, cl.EvalResponse(clientSet, query, resp))
+		}
+	}
+}
+
+// Malformed queries randomize the whole response, with the full and the planned rotation keys
+func TestMaliciousCheck(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestMaliciousCheck")
+
+	clientSet, serverSets := largeDomainSets(9)
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+
+	ld := QueryType{Psi: PSI_CA}
+	sd := QueryType{IsSmallDomain: true, Psi: PSI_CA}
+	for _, cl := range []*Client{NewClient(pp), NewClientFor(pp, ld, sd)} {
+		// A power of an empty position, which does not change the intersection
+		query, err := cl.Query(clientSet, ld)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slots := cl.expandLargeDomainSet(clientSet)
+		slots[largeDomainSlot(pp, 0, len(clientSet))+1] = 1
+		query.ctxs[0] = cl.encryptSlots(slots)
+		resp, err := sv.Respond(query, cl.GetKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ans := cl.EvalResponse(clientSet, query, resp); ans[2] == uint64(len(Intersection(clientSet, serverSets[2]))) {
+			t.Error("large domain: malformed query passes the malicious check")
+		}
+
+		// A non-binary slot in the first bit vector
+		smallSet := []uint64{3, 17, 42}
+		if query, err = cl.Query(smallSet, sd); err != nil {
+			t.Fatal(err)
+		}
+		slots = make([]uint64, pp.params.N())
+		for i := 0; i < len(slots)/pp.SdBitVecLen; i++ {
+			EncodeSetAsBitVector(smallSet, slots[i*pp.SdBitVecLen:(i+1)*pp.SdBitVecLen])
+		}
+		slots[smallSet[0]] = 2
+		query.ctxs[0] = cl.encryptSlots(slots)
+		if resp, err = sv.Respond(query, cl.GetKey()); err != nil {
+			t.Fatal(err)
+		}
+		ans := cl.EvalResponse(smallSet, query, resp)
+		for i, set := range serverSets {
+			if ans[i] == uint64(len(Intersection(smallSet, set))) {
+				t.Errorf("small domain: set %v passes the malicious check of a malformed query", i)
+			}
+		}
+	}
+}
+
+func TestPlanParams(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestPlanParams")
+
+	tv, err := NewQueryType(true, PSI_CA, MATCHING_TVERSKY, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	plan, err := PlanParams(Workload{*tv, 64, 64, 1000, 167})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 65537 is the smallest NTT-friendly prime from 2^15 for N=2^14
+	if plan.LogN != 14 || plan.T != 65537 || plan.SdBitVecLen != 256 || plan.Depth != 7 {
+		t.Errorf("tversky plan: %+v", plan)
+	}
+
+	// The plaintext modulus holds the large domain
+	ld, err := NewQueryType(false, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	plan, err = PlanParams(Workload{*ld, 16, 64, 100, 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	N := uint64(1) << plan.LogN
+	if plan.T < 1<<20 || plan.T%(2*N) != 1 || plan.T > GetBFVParam(plan.LogN).T() || !big.NewInt(int64(plan.T)).ProbablyPrime(0) {
+		t.Errorf("large domain plan: T=%v for N=%v", plan.T, N)
+	}
+	if pp := plan.NewPSIParams(); pp.params.T() != plan.T || pp.MaxDepth() != plan.MaxDepth {
+		t.Errorf("planned parameters: T=%v, depth %v, expected T=%v, depth %v", pp.params.T(), pp.MaxDepth(), plan.T, plan.MaxDepth)
+	}
+	if _, err := PlanParams(Workload{*ld, 16, 64, 100, 1 << 30}); err == nil {
+		t.Error("planning a large domain above the plaintext moduli of the presets must fail")
+	}
+
+	if _, err := PlanParams(Workload{*tv, 64, 64, 1000, 1 << 20}); err == nil {
+		t.Error("planning a small domain larger than the slots must fail")
+	}
+
+	// The planned parameters work end-to-end
+	clientSet, serverSets := largeDomainSets(29)
+
+	qt, err := NewQueryType(false, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	plan, err = PlanParams(Workload{*qt, len(clientSet), 64, len(serverSets), 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Logger.Debug().Msgf("Plan:\n%v", plan.Describe())
+	// Two bins of degree 63 take as many ciphertexts as one polynomial of degree 127
+	if plan.LogN != 13 || plan.T != 65537 || plan.MaxClientElemPerCtx != 8 || plan.ClRepNum != 16 || plan.ServerBins != 2 || plan.Ciphertexts != 4 {
+		t.Errorf("large domain plan: %+v", plan)
+	}
+	if c := binCapacity(64, 2, 2*len(serverSets)); c < 32 || c > 63 {
+		t.Errorf("bins of %v elements for sets of 64 elements in 2 bins", c)
+	}
+
+	pp := plan.NewPSIParams()
+	cl := NewClientFor(pp, *qt)
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+	query, err := cl.Query(clientSet, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sv.Respond(query, cl.GetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ans := cl.EvalResponse(clientSet, query, resp)
+	checkCardinalityResult(t, clientSet, serverSets, ans)
+}
+
+func TestMultiCtxQuery(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestMultiCtxQuery")
+
+	sets, err := RandomDataSet(12, 10, 40, 300)
+	if err != nil {
+		panic(err)
+	}
+	// 20 elements with MaxClientElemPerCtx = 8 -> 3 query ciphertexts
+	clientSet, err := RandomSet(20, 300)
+	if err != nil {
+		panic(err)
+	}
+	serverSets := sets[1:]
+	serverSets[2] = append(serverSets[2][:10], clientSet[3:17]...)
+	serverSets[5] = append([]uint64{}, clientSet...)
+	serverSets[8] = []uint64{}
+
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	pp.MaxClientElemPerCtx = 8
+	pp.ClRepNum = 2
+	pp.Update()
+	checkLargeDomainQueries(t, pp, clientSet, serverSets, 3)
+}
+
+// Checks psi, psi-ca and f-psm queries in the large domain, through the wire format
+func checkLargeDomainQueries(t *testing.T, pp *PSIParams, clientSet []uint64, serverSets [][]uint64, queryCtxNum int) {
+	cl := NewClient(pp)
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+
+	respond := func(psi PsiType, matching MatchingType) (*PsiQuery, *PsiResponse) {
+		qt, err := NewQueryType(false, psi, matching, AGGREGATION_NAIVE)
+		if err != nil {
+			panic(err)
+		}
+		query, err := cl.Query(clientSet, *qt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(query.ctxs) != queryCtxNum {
+			t.Fatalf("query has %v ciphertexts, expected %v", len(query.ctxs), queryCtxNum)
+		}
+		// The multi-ciphertext query survives the wire format
+		data, err := query.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query, err = UnmarshalQuery(data); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := sv.Respond(query, cl.GetKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return query, resp
+	}
+
+	query, resp := respond(PSI_PSI, MATCHING_NONE)
+	intersections, err := cl.EvalIntersections(clientSet, query, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, set := range serverSets {
+		expected := Intersection(clientSet, set)
+		if len(intersections[i]) != len(expected) || (len(expected) > 0 && !reflect.DeepEqual(intersections[i], expected)) {
+			t.Errorf("Set %v: intersection %v, expected %v", i, intersections[i], expected)
+		}
+	}
+
+	query, resp = respond(PSI_CA, MATCHING_NONE)
+	ans := cl.EvalResponse(clientSet, query, resp)
+	checkCardinalityResult(t, clientSet, serverSets, ans)
+
+	query, resp = respond(PSI_PSI, MATCHING_FPSM)
+	checkFPSMresult(t, clientSet, serverSets, cl.EvalResponse(clientSet, query, resp))
+}
+
+func TestServerBins(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestServerBins")
+
+	// Server sets up to 300 elements with polynomials of degree 127
+	sets, err := RandomDataSet(10, 100, 300, 5000)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, err := RandomSet(12, 5000)
+	if err != nil {
+		panic(err)
+	}
+	serverSets := sets[1:]
+	serverSets[2] = append(serverSets[2][:100], clientSet[3:9]...)
+	serverSets[5] = append(serverSets[5][:90], clientSet...)
+	serverSets[6] = []uint64{}
+	if serverSets[7], err = RandomSet(300, 5000); err != nil {
+		panic(err)
+	}
+
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	pp.MaxClientElemPerCtx = 8
+	pp.ClRepNum = 8
+	pp.ServerBins = 4
+	pp.Update()
+	checkLargeDomainQueries(t, pp, clientSet, serverSets, 2)
+
+	// Without bins, the sets do not fit
+	pp.ServerBins = 1
+	pp.Update()
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+	cl := NewClient(pp)
+	qt, err := NewQueryType(false, PSI_PSI, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	query, err := cl.Query(clientSet, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sv.Respond(query, cl.GetKey()); err == nil {
+		t.Error("responding with sets larger than the polynomial degree must fail")
+	}
+}
+
+func TestElementEncoder(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestElementEncoder")
+
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	enc := NewElementEncoder(pp, []byte("deployment key"))
+	T := pp.params.T()
+
+	if enc.EncodeString("chemistry") != enc.EncodeBytes([]byte("chemistry")) {
+		t.Error("strings and byte slices must have the same encoding")
+	}
+	if enc.EncodeID(7) == NewElementEncoder(pp, []byte("other key")).EncodeID(7) {
+		t.Error("encodings must depend on the key")
+	}
+	for _, x := range enc.EncodeIDs([]uint64{0, 1, T - 1, T, 1 << 63}) {
+		if x == 0 || x >= T {
+			t.Errorf("encoded element %v is not in [1, %v)", x, T)
+		}
+	}
+	if rate := enc.FalsePositiveRate(8, 100); rate <= 0 || rate > 1e-3 {
+		t.Errorf("unexpected false positive rate %v", rate)
+	}
+
+	// String keywords end-to-end
+	clientWords := []string{"lattice", "bfv", "psi", "matching", "privacy"}
+	serverWords := [][]string{
+		{"psi", "privacy", "go"},
+		{"rust", "c++"},
+		{"lattice", "bfv", "psi", "matching", "privacy", "fhe"},
+	}
+	clientSet := enc.EncodeStrings(clientWords)
+	serverSets := make([][]uint64, len(serverWords))
+	for i, words := range serverWords {
+		serverSets[i] = enc.EncodeStrings(words)
+	}
+	pp.MaxClientElemPerCtx = 8
+	pp.Update()
+	cl := NewClient(pp)
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+	qt, err := NewQueryType(false, PSI_PSI, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	query, err := cl.Query(clientSet, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sv.Respond(query, cl.GetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	intersections, err := cl.EvalIntersections(clientSet, query, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{2, 0, 5}
+	for i := range serverSets {
+		if len(intersections[i]) != expected[i] {
+			t.Errorf("Set %v: %v common keywords, expected %v", i, len(intersections[i]), expected[i])
+		}
+	}
+
+	// Zero and out-of-range elements are rejected
+	for _, x := range []uint64{0, T} {
+		if _, err := cl.Query([]uint64{1, x}, *qt); err == nil {
+			t.Errorf("querying element %v must fail", x)
+		}
+		sv, err := NewServer(pp, [][]uint64{{x}})
+		if err != nil {
+			panic(err)
+		}
+		if _, err := sv.Respond(query, cl.GetKey()); err == nil {
+			t.Errorf("responding with server element %v must fail", x)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestLabels")
+
+	labeled := func(sets [][]uint64) []LabeledSet {
+		out := make([]LabeledSet, len(sets))
+		for i, set := range sets {
+			out[i] = LabeledSet{Label: Label{ID: fmt.Sprintf("set-%v", i)}, Elements: set}
+		}
+		out[0].Metadata = map[string]string{"name": "first", "smiles": "CCO"}
+		return out
+	}
+	run := func(logn int, qt QueryType, clientSet []uint64, sets []LabeledSet) map[int]Label {
+		pp := NewPSIParams(GetBFVParam(logn), 128)
+		pp.Update()
+		cl := NewClientFor(pp, qt)
+		sv, err := NewLabeledServer(pp, sets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, err := cl.Query(clientSet, qt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Labels survive the wire format
+		data, err := query.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := UnmarshalQuery(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !received.queryType.WithLabels {
+			t.Fatal("the query lost the label flag")
+		}
+		resp, err := sv.Respond(received, cl.GetKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = resp.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err = UnmarshalResponse(data); err != nil {
+			t.Fatal(err)
+		}
+		labels, err := cl.EvalLabels(query, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return labels
+	}
+	// IDs in server order, each label must be at the index of its set
+	ids := func(labels map[int]Label) []string {
+		indices := make([]int, 0, len(labels))
+		for n := range labels {
+			indices = append(indices, n)
+		}
+		sort.Ints(indices)
+		out := make([]string, len(indices))
+		for i, n := range indices {
+			if out[i] = labels[n].ID; out[i] != fmt.Sprintf("set-%v", n) {
+				t.Errorf("label %v at index %v", out[i], n)
+			}
+		}
+		return out
+	}
+
+	// f-psm: sets containing the whole client set
+	fpsm, _ := NewQueryType(false, PSI_PSI, MATCHING_FPSM, AGGREGATION_NAIVE)
+	fpsm.WithLabels = true
+	sets := labeled([][]uint64{{7, 11, 13}, {7, 13}, {1, 2, 3}, {11, 7, 5, 9}, {}})
+	labels := run(14, *fpsm, []uint64{7, 11}, sets)
+	if !reflect.DeepEqual(ids(labels), []string{"set-0", "set-3"}) {
+		t.Errorf("f-psm labels %v", ids(labels))
+	}
+	if !reflect.DeepEqual(labels[0].Metadata, sets[0].Metadata) {
+		t.Errorf("metadata %v", labels[0].Metadata)
+	}
+
+	// The planner accounts for the randomization of the labels
+	plan, err := PlanParams(Workload{*fpsm, 2, 4, len(sets), 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.LogN != 14 {
+		t.Errorf("labeled f-psm plan: %+v", plan)
+	}
+
+	// tversky: same sets as TestTverskySmall
+	tversky, _ := NewQueryType(true, PSI_CA, MATCHING_TVERSKY, AGGREGATION_NAIVE)
+	tversky.WithLabels = true
+	sets = labeled([][]uint64{
+		{1, 2, 3, 4, 5, 6},
+		{1, 2, 3, 4, 5},
+		{1, 2, 3, 4, 5, 6, 7},
+		{1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{10, 20, 30, 40, 50, 60},
+	})
+	labels = run(15, *tversky, []uint64{1, 2, 3, 4, 5, 6}, sets)
+	if !reflect.DeepEqual(ids(labels), []string{"set-0", "set-1", "set-2"}) {
+		t.Errorf("tversky labels %v", ids(labels))
+	}
+
+	// Labels require binary results of individual sets and a labeled server
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	cl := NewClient(pp)
+	xms := *fpsm
+	xms.Aggregation = AGGREGATION_X_MS
+	if _, err := cl.Query([]uint64{7}, xms); err == nil {
+		t.Error("labels accepted with aggregation")
+	}
+	sv, err := NewServer(pp, [][]uint64{{7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := cl.Query([]uint64{7}, *fpsm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sv.Respond(query, cl.GetKey()); err == nil {
+		t.Error("labels requested from an unlabeled server")
+	}
+	if _, err := NewLabeledServer(pp, []LabeledSet{{Label: Label{ID: "a"}}, {Label: Label{ID: "a"}}}); err == nil {
+		t.Error("duplicate IDs accepted")
+	}
+}
+
+func TestFermatIsZero(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestFermatIsZero")
+
+	pp := NewPSIParams(GetFermatBFVParam(), 2)
+	cl := NewClientFor(pp)
+	evaluator := bfv.NewEvaluator(pp.params, *cl.evk)
+	T := pp.params.T()
+
+	x := GenRandomVector(pp.params.N(), T, true)
+	y := GenRandomVector(pp.params.N(), T, true)
+	for i := 0; i < len(x); i += 3 {
+		x[i] = 0
+		y[i+1] = x[i+1]
+	}
+	ctxX, ctxY := cl.encryptSlots(x), cl.encryptSlots(y)
+	decrypt := func(ctx *bfv.Ciphertext) []uint64 {
+		return cl.encoder.DecodeUintNew(cl.decryptor.DecryptNew(ctx))
+	}
+
+	for _, n := range []int{1, 2, 7, 12} {
+		pow, err := Pow(evaluator, ctxX, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range decrypt(pow)[:16] {
+			expected := uint64(1)
+			for k := 0; k < n; k++ {
+				expected = expected * x[i] % T
+			}
+			if v != expected {
+				t.Fatalf("x[%v]^%v = %v, expected %v", i, n, v, expected)
+			}
+		}
+	}
+	if powDepth(int(T-1)) != 16 || powDepth(12) != 4 {
+		t.Errorf("pow depths %v %v", powDepth(int(T-1)), powDepth(12))
+	}
+
+	zero, err := IsZero(pp, evaluator, ctxX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal, err := IsEqual(pp, evaluator, ctxX, ctxY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zeroData, equalData := decrypt(zero), decrypt(equal)
+	for i := range x {
+		expected := uint64(0)
+		if x[i] == 0 {
+			expected = 1
+		}
+		if zeroData[i] != expected {
+			t.Fatalf("IsZero(%v) = %v", x[i], zeroData[i])
+		}
+		expected = 0
+		if x[i] == y[i] {
+			expected = 1
+		}
+		if equalData[i] != expected {
+			t.Fatalf("IsEqual(%v, %v) = %v", x[i], y[i], equalData[i])
+		}
+	}
+
+	// The default presets do not support the depth
+	pp13 := NewPSIParams(GetBFVParam(13), 2)
+	cl13 := NewClientFor(pp13)
+	if _, err := IsZero(pp13, bfv.NewEvaluator(pp13.params, *cl13.evk), cl13.encryptSlots(x[:16])); err == nil {
+		t.Error("IsZero accepted parameters without enough depth")
+	}
+}
+
+func TestThresholdAggregation(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestThresholdAggregation")
+
+	check := func(logn int, qt QueryType, clientSet []uint64, serverSets [][]uint64, matches int) {
+		for _, k := range []int{1, matches, matches + 1} {
+			qt.Threshold = k
+			_, ans := runHomoPsi(logn, clientSet, serverSets, qt, 1)
+			expected := uint64(0)
+			if matches >= k {
+				expected = 1
+			}
+			if len(ans) != 1 || ans[0] != expected {
+				t.Errorf("matching %v, aggregation th-ms with threshold %v: %v, expected %v", qt.Matching, k, ans, expected)
+			}
+		}
+	}
+
+	// tversky: same sets as TestTverskySmall, 3 matches
+	tversky, _ := NewQueryType(true, PSI_CA, MATCHING_TVERSKY, AGGREGATION_TH_MS)
+	check(15, *tversky, []uint64{1, 2, 3, 4, 5, 6}, [][]uint64{
+		{1, 2, 3, 4, 5, 6},
+		{1, 2, 3, 4, 5},
+		{1, 2, 3, 4, 5, 6, 7},
+		{1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{10, 20, 30, 40, 50, 60},
+	}, 3)
+
+	// f-psm: 2 of the sets contain the client set
+	fpsm, _ := NewQueryType(false, PSI_PSI, MATCHING_FPSM, AGGREGATION_TH_MS)
+	sets, err := RandomDataSet(12, 3, 20, 500)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, serverSets := sets[0][:3], sets[1:]
+	serverSets[4] = append(serverSets[4], clientSet...)
+	serverSets[9] = append(serverSets[9], clientSet...)
+	matches := 0
+	for _, set := range serverSets {
+		if len(Intersection(clientSet, set)) == len(clientSet) {
+			matches++
+		}
+	}
+	check(15, *fpsm, clientSet, serverSets, matches)
+
+	// The threshold is part of the query
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	cl := NewClient(pp)
+	fpsm.Threshold = 0
+	if _, err := cl.Query(clientSet, *fpsm); err == nil {
+		t.Error("th-ms accepted a zero threshold")
+	}
+	fpsm.Threshold = 3
+	query, err := cl.Query(clientSet, *fpsm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := UnmarshalQuery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.queryType != query.queryType {
+		t.Errorf("query type %+v, expected %+v", received.queryType, query.queryType)
+	}
+
+	// The threshold is bounded by MaxThreshold, the number of server sets, and the cost of the product tree
+	fpsm.Threshold = MaxThreshold + 1
+	if _, err := cl.Query(clientSet, *fpsm); err == nil {
+		t.Errorf("th-ms accepted a threshold above %v", MaxThreshold)
+	}
+	sv, err := NewServer(pp, serverSets[:2])
+	if err != nil {
+		panic(err)
+	}
+	if _, err := sv.Respond(received, cl.GetKey()); err == nil {
+		t.Error("th-ms accepted a threshold above the number of server sets")
+	}
+	fpsm.Threshold = MaxThreshold
+	if _, err := sv.newSession(cl.GetKey()).aggregateThreshold(*fpsm, make([]*bfv.Ciphertext, 64)); err == nil {
+		t.Error("th-ms accepted a product tree above the budget")
+	}
+}
+
+func TestFPSMExistence(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestFPSMExistence")
+
+	qt, err := NewQueryType(false, PSI_PSI, MATCHING_FPSM, AGGREGATION_X_MS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(pp *PSIParams, clientSet []uint64, serverSets [][]uint64) ([]uint64, error) {
+		cl := NewClientFor(pp, *qt)
+		sv, err := NewServer(pp, serverSets)
+		if err != nil {
+			return nil, err
+		}
+		query, err := cl.Query(clientSet, *qt)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := sv.Respond(query, cl.GetKey())
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.ctxs) != 1 {
+			t.Errorf("x-ms response has %v ciphertexts", len(resp.ctxs))
+		}
+		return cl.EvalResponse(clientSet, query, resp), nil
+	}
+
+	// Server sets of one element fill two batched response ciphertexts.
+	// Their product needs depth log2(N) + 2, which only the Fermat preset supports.
+	pp := NewPSIParams(GetFermatBFVParam(), 2)
+	N := int(pp.params.N())
+	pp.MaxClientElemPerCtx = 2
+	pp.ClRepNum = N / 4
+	pp.Update()
+
+	serverSets := make([][]uint64, N+5)
+	for i := range serverSets {
+		serverSets[i] = []uint64{uint64(i%1000 + 2)}
+	}
+	for _, match := range []int{-1, 7, N + 3} {
+		clientSet := []uint64{1}
+		if match >= 0 {
+			serverSets[match] = []uint64{1}
+		}
+		ans, err := run(pp, clientSet, serverSets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := uint64(0)
+		if match >= 0 {
+			expected = 1
+			serverSets[match] = []uint64{2}
+		}
+		if !reflect.DeepEqual(ans, []uint64{expected}) {
+			t.Errorf("match %v: x-ms result %v, expected %v", match, ans, expected)
+		}
+	}
+
+	// The error of a collection that exceeds the depth of the parameters reaches the caller
+	pp = NewPSIParams(GetBFVParam(13), 2)
+	serverSets = make([][]uint64, 64)
+	for i := range serverSets {
+		serverSets[i] = []uint64{uint64(i + 2)}
+	}
+	if _, err := run(pp, []uint64{2}, serverSets); err == nil {
+		t.Error("x-ms aggregation beyond the depth of P_8k accepted")
+	}
+}
+
+func TestSmallDomainFPSM(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestSmallDomainFPSM")
+
+	clientSet := []uint64{3, 5, 8, 13}
+	serverSets := [][]uint64{
+		{3, 5, 8, 13},
+		{1, 3, 5, 8, 13, 21},
+		{3, 5, 8},
+		{3, 5, 9, 13},
+		{},
+		{100, 200},
+	}
+
+	for _, m := range []MatchingType{MATCHING_FPSM_SUBSET, MATCHING_FPSM_SUPERSET, MATCHING_FPSM_EQUAL} {
+		matches := uint64(0)
+		expected := make([]uint64, len(serverSets))
+		for i, set := range serverSets {
+			if PlainFPSM(m, clientSet, set) {
+				expected[i] = 1
+				matches++
+			}
+		}
+
+		for _, agg := range []AggregationType{AGGREGATION_NAIVE, AGGREGATION_X_MS, AGGREGATION_CA_MS} {
+			qt, err := NewQueryType(true, PSI_CA, m, agg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, ans := runHomoPsi(14, clientSet, serverSets, *qt, 1)
+
+			want := expected
+			if agg == AGGREGATION_CA_MS {
+				want = []uint64{matches}
+			} else if agg == AGGREGATION_X_MS {
+				want = []uint64{0}
+				if matches > 0 {
+					want[0] = 1
+				}
+			}
+			if !reflect.DeepEqual(ans, want) {
+				t.Errorf("matching %v, aggregation %v: result %v, expected %v", m, agg, ans, want)
+			}
+		}
+	}
+
+	// Without a match, slots without a server set must not count as one
+	qt, err := NewQueryType(true, PSI_CA, MATCHING_FPSM_SUPERSET, AGGREGATION_X_MS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ans := runHomoPsi(14, clientSet, serverSets[5:], *qt, 1); !reflect.DeepEqual(ans, []uint64{0}) {
+		t.Errorf("x-ms superset result %v without a match", ans)
+	}
+
+	// Small domain f-psm needs a small domain psi-ca query
+	qt, err = NewQueryType(false, PSI_PSI, MATCHING_FPSM_SUBSET, AGGREGATION_NAIVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSmallDomainFPSMQuery(*qt); err == nil {
+		t.Error("large domain subset matching accepted")
+	}
+}
+
+func TestSimilarityMetrics(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestSimilarityMetrics")
+
+	clientSet := []uint64{3, 5, 8, 13}
+	serverSets := [][]uint64{
+		{3, 5, 8, 13},
+		{3, 5, 8, 13, 21},
+		{3, 5, 8, 13, 21, 34, 55},
+		{3, 5, 8},
+		{3, 5, 20, 30},
+		{3, 5},
+		{3},
+		{100, 200},
+	}
+
+	// The range check of the quadratic cosine scores needs N=2^15
+	metrics := []struct {
+		matching  MatchingType
+		plain     func(set1, set2 []uint64) float64
+		threshold float64
+		paramSize int
+	}{
+		{MATCHING_JACCARD, PlainJaccard, 0.6, 14},
+		{MATCHING_DICE, PlainDice, 0.7, 14},
+		{MATCHING_COSINE, PlainCosine, 0.5, 15},
+		{MATCHING_OVERLAP, PlainOverlap, 0.75, 14},
+	}
+	for _, metric := range metrics {
+		qt, err := NewQueryType(true, PSI_CA, metric.matching, AGGREGATION_NAIVE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qt.Similarity.Threshold = metric.threshold
+		qt.Similarity.MaxCardinality = len(clientSet)
+
+		expected := make([]uint64, len(serverSets))
+		for i, set := range serverSets {
+			match := SimilarityMatch(metric.matching, qt.Similarity, clientSet, set)
+			if plainMatch := metric.plain(clientSet, set) >= metric.threshold-1e-9; plainMatch != match {
+				t.Errorf("matching %v, set %v: inequality %v, plaintext similarity %v", metric.matching, i, match, plainMatch)
+			}
+			if match {
+				expected[i] = 1
+			}
+		}
+
+		_, ans := runHomoPsi(metric.paramSize, clientSet, serverSets, *qt, 1)
+		if !reflect.DeepEqual(ans, expected) {
+			t.Errorf("matching %v: result %v, expected %v", metric.matching, ans, expected)
+		}
+	}
+
+	// Aggregation of the tanimoto similarity
+	for _, agg := range []AggregationType{AGGREGATION_X_MS, AGGREGATION_CA_MS} {
+		qt, err := NewQueryType(true, PSI_CA, MATCHING_JACCARD, agg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qt.Similarity.Threshold = 0.6
+		qt.Similarity.MaxCardinality = len(clientSet)
+
+		_, ans := runHomoPsi(15, clientSet, serverSets[1:6], *qt, 1)
+		expected := []uint64{1}
+		if agg == AGGREGATION_CA_MS {
+			expected[0] = 2
+		}
+		if !reflect.DeepEqual(ans, expected) {
+			t.Errorf("aggregation %v: result %v, expected %v", agg, ans, expected)
+		}
+	}
+
+	// Quadratic scores must not wrap around the plaintext modulus
+	qt, err := NewQueryType(true, PSI_CA, MATCHING_COSINE, AGGREGATION_NAIVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSimilarityParams(*qt, 163841, 256, 1<<20, -1); err == nil {
+		t.Error("cosine scores beyond the plaintext modulus accepted")
+	}
+}
+
+func TestHammingMatching(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestHammingMatching")
+
+	// 64-bit perceptual hashes
+	sets, err := RandomDataSet(9, 20, 40, 64)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, serverSets := sets[0], sets[1:]
+	// near duplicates at distance 0, 1, 2, 3, and 5
+	for i, flips := range []int{0, 1, 2, 3, 5} {
+		serverSets[i] = append([]uint64{}, clientSet[flips:]...)
+	}
+
+	radius := 3
+	for _, agg := range []AggregationType{AGGREGATION_NAIVE, AGGREGATION_X_MS, AGGREGATION_CA_MS} {
+		qt, err := NewQueryType(true, PSI_CA, MATCHING_HAMMING, agg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qt.HammingRadius = radius
+
+		expected := make([]uint64, len(serverSets))
+		matches := uint64(0)
+		for i, set := range serverSets {
+			if PlainHamming(clientSet, set) <= radius {
+				expected[i] = 1
+				matches++
+			}
+		}
+		if agg == AGGREGATION_X_MS {
+			expected = []uint64{1}
+		} else if agg == AGGREGATION_CA_MS {
+			expected = []uint64{matches}
+		}
+
+		_, ans := runHomoPsi(14, clientSet, serverSets, *qt, 1)
+		if !reflect.DeepEqual(ans, expected) {
+			t.Errorf("aggregation %v: result %v, expected %v", agg, ans, expected)
+		}
+	}
+
+	// The radius is part of the query
+	qt, err := NewQueryType(true, PSI_CA, MATCHING_HAMMING, AGGREGATION_NAIVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qt.HammingRadius = radius
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	query, err := NewClientFor(pp, *qt).Query(clientSet, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := UnmarshalQuery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.queryType != query.queryType {
+		t.Errorf("query type %+v, expected %+v", received.queryType, query.queryType)
+	}
+
+	qt.HammingRadius = -1
+	if err := checkQuery(pp, *qt); err == nil {
+		t.Error("negative hamming radius accepted")
+	}
+}
+
+func TestSmallDomainPSI(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestSmallDomainPSI")
+
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	// More server sets than one response ciphertext holds
+	sets, err := RandomDataSet(pp.sdSetsPerCtx+9, 20, 40, pp.SdBitVecLen-1)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, serverSets := sets[0], sets[1:]
+	serverSets[3] = append([]uint64{}, clientSet...)
+	serverSets[pp.sdSetsPerCtx+2] = append(serverSets[pp.sdSetsPerCtx+2][:5], clientSet[:7]...)
+
+	qt, err := NewQueryType(true, PSI_PSI, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	cl := NewClientFor(pp, *qt)
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+	query, err := cl.Query(clientSet, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sv.Respond(query, cl.GetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intersections, err := cl.EvalIntersections(clientSet, query, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intersections) != len(serverSets) {
+		t.Fatalf("expected %v intersections, got %v", len(serverSets), len(intersections))
+	}
+	for i, set := range serverSets {
+		if len(intersections[i]) != len(Intersection(clientSet, set)) || (len(intersections[i]) > 0 && !reflect.DeepEqual(intersections[i], Intersection(clientSet, set))) {
+			t.Errorf("Set %v: intersection %v, expected %v", i, intersections[i], Intersection(clientSet, set))
+		}
+	}
+	if ans := cl.EvalResponse(clientSet, query, resp); !reflect.DeepEqual(ans, intersections[0]) {
+		t.Errorf("EvalResponse returned %v, expected %v", ans, intersections[0])
+	}
+
+	qt.Aggregation = AGGREGATION_X_MS
+	if _, err := cl.Query(clientSet, *qt); err == nil {
+		t.Error("small domain psi with aggregation accepted")
+	}
+}
+
+func TestPackedQueries(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestPackedQueries")
+
+	sets, err := RandomDataSet(45, 20, 40, 255)
+	if err != nil {
+		panic(err)
+	}
+	// 5 client sets are packed as 8
+	clientSets, serverSets := sets[:5], sets[5:]
+	serverSets[4] = append([]uint64{}, clientSets[2]...)
+	serverSets[17] = append([]uint64{}, clientSets[4][1:]...)
+
+	for _, test := range []struct {
+		matching MatchingType
+		logn     int
+		expected func(client, server []uint64) uint64
+	}{
+		{MATCHING_NONE, 13, func(client, server []uint64) uint64 { return uint64(len(Intersection(client, server))) }},
+		{MATCHING_HAMMING, 14, func(client, server []uint64) uint64 {
+			if PlainHamming(client, server) <= 2 {
+				return 1
+			}
+			return 0
+		}},
+	} {
+		qt, err := NewQueryType(true, PSI_CA, test.matching, AGGREGATION_NAIVE)
+		if err != nil {
+			panic(err)
+		}
+		qt.HammingRadius = 2
+
+		pp := NewPSIParams(GetBFVParam(test.logn), 128)
+		packed := *qt
+		packed.PackedQueries = 8
+		cl := NewClientFor(pp, packed)
+		sv, err := NewServer(pp, serverSets)
+		if err != nil {
+			panic(err)
+		}
+		query, err := cl.QueryBatch(clientSets, *qt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := sv.Respond(query, cl.GetKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results, err := cl.EvalBatchResponse(clientSets, query, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(clientSets) {
+			t.Fatalf("expected %v results, got %v", len(clientSets), len(results))
+		}
+		for j, client := range clientSets {
+			expected := make([]uint64, len(serverSets))
+			for n, server := range serverSets {
+				expected[n] = test.expected(client, server)
+			}
+			if !reflect.DeepEqual(results[j], expected) {
+				t.Errorf("matching %v, client set %v: result %v, expected %v", test.matching, j, results[j], expected)
+			}
+		}
+		if ans := cl.EvalResponse(clientSets[0], query, resp); !reflect.DeepEqual(ans, results[0]) {
+			t.Errorf("EvalResponse returned %v, expected %v", ans, results[0])
+		}
+	}
+
+	pp := NewPSIParams(GetBFVParam(13), 128)
+
+	// Every server set meets every packed set once, the empty blocks meet none
+	setNum := pp.sdSetsPerCtx + 5
+	seen := make(map[[2]int]int)
+	for p, n := range packedOrder(pp, setNum, 4) {
+		if n >= 0 {
+			seen[[2]int{n, p % 4}]++
+		}
+	}
+	if len(seen) != 4*setNum {
+		t.Errorf("packed layout: %v pairs of server and client sets, expected %v", len(seen), 4*setNum)
+	}
+	for pair, count := range seen {
+		if count != 1 {
+			t.Errorf("packed layout: server set %v meets client set %v %v times", pair[0], pair[1], count)
+		}
+	}
+
+	qt, err := NewQueryType(true, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	cl := NewClient(pp)
+
+	// The number of packed sets is part of the query
+	query, err := cl.QueryBatch(clientSets[:3], *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := UnmarshalQuery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.queryType.PackedQueries != 4 {
+		t.Errorf("received %v packed queries, expected 4", received.queryType.PackedQueries)
+	}
+
+	// A row must hold two copies of the packed sets
+	if _, err := cl.QueryBatch(sets[:9], *qt); err == nil {
+		t.Error("too many packed queries accepted")
+	}
+	qt.Aggregation = AGGREGATION_X_MS
+	if _, err := cl.QueryBatch(clientSets, *qt); err == nil {
+		t.Error("packed queries with aggregation accepted")
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestConcurrentClients")
+
+	sets, err := RandomDataSet(60, 20, 40, 255)
+	if err != nil {
+		panic(err)
+	}
+	clientSets, serverSets := sets[:4], sets[4:]
+
+	qt, err := NewQueryType(true, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	sv, err := NewServer(pp, serverSets, WithWorkers(2))
+	if err != nil {
+		panic(err)
+	}
+
+	// Every client has its own key, and all the queries are answered at the same time
+	answers := make([][]uint64, len(clientSets))
+	errs := make([]error, len(clientSets))
+	var wg sync.WaitGroup
+	for i := range clientSets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cl := NewClientFor(pp, *qt)
+			query, err := cl.Query(clientSets[i], *qt)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			resp, err := sv.Respond(query, cl.GetKey())
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			answers[i] = cl.EvalResponse(clientSets[i], query, resp)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, client := range clientSets {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		expected := make([]uint64, len(serverSets))
+		for n, server := range serverSets {
+			expected[n] = uint64(len(Intersection(client, server)))
+		}
+		if !reflect.DeepEqual(answers[i], expected) {
+			t.Errorf("client %v: result %v, expected %v", i, answers[i], expected)
+		}
+	}
+}
+
+func TestPreprocess(t *testing.T) {
+	Logger.Info().Msgf("\n    Test: running TestPreprocess")
+
+	respond := func(cl *Client, sv *Server, clientSet []uint64, qt *QueryType) []uint64 {
+		query, err := cl.Query(clientSet, *qt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := sv.Respond(query, cl.GetKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cl.EvalResponse(clientSet, query, resp)
+	}
+
+	// Small domain: cached batches in the raw order, rotated for packed queries
+	pp := NewPSIParams(GetBFVParam(13), 128)
+	sets, err := RandomDataSet(pp.sdSetsPerCtx+21, 20, 40, 255)
+	if err != nil {
+		panic(err)
+	}
+	clientSets, serverSets := sets[:2], sets[2:]
+	sv, err := NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+	if err := sv.Preprocess(true); err != nil {
+		t.Fatal(err)
+	}
+	if len(sv.bitVecPtxs) != 2 {
+		t.Fatalf("expected 2 preprocessed batches, got %v", len(sv.bitVecPtxs))
+	}
+	cl := NewClient(pp)
+	qt, err := NewQueryType(true, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	expected := make([][]uint64, len(clientSets))
+	for j, client := range clientSets {
+		expected[j] = make([]uint64, len(serverSets))
+		for n, server := range serverSets {
+			expected[j][n] = uint64(len(Intersection(client, server)))
+		}
+	}
+	if ans := respond(cl, sv, clientSets[0], qt); !reflect.DeepEqual(ans, expected[0]) {
+		t.Errorf("preprocessed small domain: result %v, expected %v", ans, expected[0])
+	}
+	query, err := cl.QueryBatch(clientSets, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sv.Respond(query, cl.GetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err := cl.EvalBatchResponse(clientSets, query, resp); err != nil || !reflect.DeepEqual(results, expected) {
+		t.Errorf("preprocessed packed query: result %v (%v), expected %v", results, err, expected)
+	}
+
+	// Preprocessing again waits for the running queries
+	done := make(chan error)
+	go func() {
+		done <- sv.Preprocess(true)
+	}()
+	if ans := respond(cl, sv, clientSets[1], qt); !reflect.DeepEqual(ans, expected[1]) {
+		t.Errorf("query during preprocessing: result %v, expected %v", ans, expected[1])
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Large domain: cached polynomials, also for shuffled sets
+	sets, err = RandomDataSet(10, 150, 300, 5000)
+	if err != nil {
+		panic(err)
+	}
+	clientSet := sets[0][:6]
+	serverSets = sets[1:]
+	serverSets[2] = append(serverSets[2][:100], clientSet...)
+	serverSets[5] = append(serverSets[5][:90], clientSet[2:]...)
+	serverSets[7] = append(serverSets[7][:150], clientSet...)
+
+	pp = NewPSIParams(GetBFVParam(13), 128)
+	pp.MaxClientElemPerCtx = 8
+	pp.ClRepNum = 8
+	pp.ServerBins = 4
+	pp.Update()
+	sv, err = NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+	if err := sv.Preprocess(false); err != nil {
+		t.Fatal(err)
+	}
+	cl = NewClient(pp)
+
+	qt, err = NewQueryType(false, PSI_CA, MATCHING_NONE, AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+	ans := respond(cl, sv, clientSet, qt)
+	for n, server := range serverSets {
+		if ans[n] != uint64(len(Intersection(clientSet, server))) {
+			t.Errorf("preprocessed large domain, set %v: cardinality %v, expected %v", n, ans[n], len(Intersection(clientSet, server)))
+		}
+	}
+	qt, err = NewQueryType(false, PSI_PSI, MATCHING_FPSM, AGGREGATION_CA_MS)
+	if err != nil {
+		panic(err)
+	}
+	if ans := respond(cl, sv, clientSet, qt); !reflect.DeepEqual(ans, []uint64{2}) {
+		t.Errorf("preprocessed large domain ca-ms: result %v, expected [2]", ans)
+	}
+
+	// Without bins, the sets do not fit
+	pp.ServerBins = 1
+	pp.Update()
+	if sv, err = NewServer(pp, serverSets); err != nil {
+		panic(err)
+	}
+	if err := sv.Preprocess(false); err == nil || !strings.HasPrefix(err.Error(), "server set ") {
+		t.Errorf("preprocessing sets larger than the polynomial degree must name the set, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package psm
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Hamming matching compares fixed-length bit vectors, e.g., perceptual hashes: a server set S matches
+// the client set X if the Hamming distance of their bit vectors, |X| + |S| - 2|X∩S|, is at most
+// QueryType.HammingRadius. The server computes the distance from the output of computePSI_CA_SD
+// and the cardinalities, and checks it with IsInRange.
+
+// Hamming matching runs on small domain psi-ca, with naive, x-ms, or ca-ms aggregation.
+func checkHammingParams(qt QueryType, rangeLim, maxDepth int) error {
+	if qt.Matching != MATCHING_HAMMING {
+		return nil
+	}
+	if !qt.IsSmallDomain || qt.Psi != PSI_CA {
+		return errors.New("hamming matching requires small domain psi-ca")
+	}
+	if qt.Aggregation != AGGREGATION_NAIVE && qt.Aggregation != AGGREGATION_X_MS && qt.Aggregation != AGGREGATION_CA_MS {
+		return errors.New("hamming matching supports naive, x-ms, and ca-ms aggregation")
+	}
+	if qt.HammingRadius < 0 {
+		return errors.New("the hamming radius must be non-negative")
+	}
+	if qt.HammingRadius >= rangeLim {
+		return fmt.Errorf("hamming radius %v exceeds the range limit of the parameters (%v)", qt.HammingRadius, rangeLim)
+	}
+	if depth := hammingDepth(qt); maxDepth >= 0 && depth > maxDepth {
+		return fmt.Errorf("hamming matching requires depth %v but the parameters only support %v", depth, maxDepth)
+	}
+	return nil
+}
+
+// Multiplicative depth of the range check on distances in [0, HammingRadius]
+func hammingDepth(qt QueryType) int {
+	return bits.Len(uint(qt.HammingRadius))
+}
+
+// PlainHamming computes the Hamming distance of the bit vectors of two sets in plaintext.
+func PlainHamming(set1 []uint64, set2 []uint64) int {
+	return len(set1) + len(set2) - 2*len(Intersection(set1, set2))
+}
+
+// Checks the distance of every server set from the output of computePSI_CA_SD, batched into
+// the minimal number of ctxs. The result of a set is zero iff it matches.
+func (sv *session) computeHamming(query *PsiQuery, intersectionCaCtx []*bfv.Ciphertext) ([]*bfv.Ciphertext, error) {
+	radius := query.queryType.HammingRadius
+
+	// 2|X∩S| - |X| - |S| is the opposite of the distance
+	ctxs, err := sv.computeLinearScore(query, intersectionCaCtx, 2, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	ctxs = BatchSIMDctxs(sv.pp, sv.evaluator, ctxs, sv.pp.SdBitVecLen)
+
+	err = sv.parallelFor(len(ctxs), func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
+		evaluator.Neg(ctxs[k], ctxs[k])
+		ctxs[k] = IsInRange(sv.pp, evaluator, ctxs[k], radius+1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ctxs, nil
+}
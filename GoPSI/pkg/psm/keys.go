@@ -0,0 +1,244 @@
+package psm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters used to derive the encryption key of saved key material
+const (
+	keyFileScryptN = 1 << 15
+	keyFileScryptR = 8
+	keyFileScryptP = 1
+	keyFileSaltLen = 16
+)
+
+// ID returns a stable identifier of the key (hex encoded SHA-256 of its wire encoding).
+// Servers use it to cache evaluation keys between queries.
+func (key *ClientKey) ID() (string, error) {
+	if key.id != "" {
+		return key.id, nil
+	}
+	data, err := key.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	key.id = KeyIDFromBinary(data)
+	return key.id, nil
+}
+
+// KeyIDFromBinary returns the ID of a marshaled client key without decoding it.
+func KeyIDFromBinary(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// CheckKey verifies that a client key was generated for the parameters of the server: every
+// polynomial has the ring degree of the parameters and is reduced modulo each of their moduli.
+func (sv *Server) CheckKey(key *ClientKey) error {
+	params := sv.pp.params
+	moduli := append(params.Qi(), params.Pi()...)
+	if err := checkPolys(params, moduli, key.pk.Value[:]...); err != nil {
+		return fmt.Errorf("public key: %v", err)
+	}
+	if key.evk == nil || key.evk.Rlk == nil || len(key.evk.Rlk.Keys) == 0 {
+		return errors.New("keys: missing relinearization key")
+	}
+	for _, swk := range key.evk.Rlk.Keys {
+		if err := checkSwitchingKey(params, moduli, swk.Value); err != nil {
+			return fmt.Errorf("relinearization key: %v", err)
+		}
+	}
+	if key.evk.Rtks != nil {
+		for galEl, swk := range key.evk.Rtks.Keys {
+			if err := checkSwitchingKey(params, moduli, swk.Value); err != nil {
+				return fmt.Errorf("rotation key %v: %v", galEl, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkSwitchingKey(params *bfv.Parameters, moduli []uint64, value [][2]*ring.Poly) error {
+	if uint64(len(value)) != params.Beta() {
+		return fmt.Errorf("keys: %v decomposition elements instead of %v", len(value), params.Beta())
+	}
+	for _, el := range value {
+		if err := checkPolys(params, moduli, el[:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks that every polynomial has the ring degree of the parameters and is reduced modulo each of the moduli.
+func checkPolys(params *bfv.Parameters, moduli []uint64, polys ...*ring.Poly) error {
+	for _, p := range polys {
+		if p == nil || len(p.Coeffs) != len(moduli) {
+			return errors.New("the number of moduli does not match the parameters")
+		}
+		for i, q := range moduli {
+			if uint64(len(p.Coeffs[i])) != params.N() {
+				return fmt.Errorf("ring degree %v instead of %v", len(p.Coeffs[i]), params.N())
+			}
+			for _, c := range p.Coeffs[i] {
+				if c >= q {
+					return errors.New("coefficient not reduced modulo the parameters")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// MaxKeySize returns the size of the wire encoding of a client key with the rotation keys of NewClient,
+// the largest key accepted for the parameters of the server.
+func (sv *Server) MaxKeySize() int64 {
+	params := sv.pp.params
+	poly := int64(params.N()*params.QPiCount())*8 + 2
+	swk := 1 + 2*int64(params.Beta())*poly
+	// pow2 rotations, -1, and the row swap
+	rotNum := int64(bits.Len64(params.N())) + 1
+	// relinearization of degree 2 ciphertexts (see newClientWithRotations), and the constant
+	// covers the header, length prefixes, and galois elements
+	return 64 + 2*poly + 1 + 2*swk + rotNum*(16+swk)
+}
+
+// SaveKeys serializes the key material of the client (secret, public, and evaluation keys).
+// If passphrase is not empty, the output is encrypted with AES-GCM under a key derived with scrypt.
+func (cl *Client) SaveKeys(passphrase string) (data []byte, err error) {
+	var buff []byte
+	if buff, err = cl.pp.params.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	payload := writeWireBlob(nil, buff)
+	if buff, err = cl.sk.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	payload = writeWireBlob(payload, buff)
+	if buff, err = cl.GetKey().MarshalBinary(); err != nil {
+		return nil, err
+	}
+	payload = writeWireBlob(payload, buff)
+
+	data = writeWireHeader(wireTagClientSecret)
+	if passphrase == "" {
+		data = append(data, 0)
+		return append(data, payload...), nil
+	}
+
+	salt := make([]byte, keyFileSaltLen)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := newKeyFileCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	data = append(data, 1)
+	data = append(data, salt...)
+	data = append(data, nonce...)
+	// authenticate the header as well
+	return aead.Seal(data, nonce, payload, data[:2]), nil
+}
+
+// LoadClient restores a client from key material created with SaveKeys.
+// The parameters must be the ones used when the keys were generated, and the passphrase the one
+// given to SaveKeys (empty for unencrypted key material).
+func LoadClient(pp *PSIParams, data []byte, passphrase string) (*Client, error) {
+	header := data
+	data, err := readWireHeader(data, wireTagClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1 {
+		return nil, errors.New("keys: missing encryption flag")
+	}
+
+	payload := data[1:]
+	if data[0] == 1 {
+		if passphrase == "" {
+			return nil, errors.New("keys: key material is encrypted, a passphrase is required")
+		}
+		if len(payload) < keyFileSaltLen {
+			return nil, errors.New("keys: truncated key material")
+		}
+		aead, err := newKeyFileCipher(passphrase, payload[:keyFileSaltLen])
+		if err != nil {
+			return nil, err
+		}
+		payload = payload[keyFileSaltLen:]
+		if len(payload) < aead.NonceSize() {
+			return nil, errors.New("keys: truncated key material")
+		}
+		nonce := payload[:aead.NonceSize()]
+		if payload, err = aead.Open(nil, nonce, payload[aead.NonceSize():], header[:2]); err != nil {
+			return nil, errors.New("keys: wrong passphrase or corrupted key material")
+		}
+	} else if data[0] != 0 {
+		return nil, errors.New("keys: invalid encryption flag")
+	} else if passphrase != "" {
+		return nil, errors.New("keys: key material is not encrypted, but a passphrase was given")
+	}
+
+	var buff []byte
+	if buff, payload, err = readWireBlob(payload); err != nil {
+		return nil, err
+	}
+	params := new(bfv.Parameters)
+	if err = params.UnmarshalBinary(buff); err != nil {
+		return nil, err
+	}
+	if !params.Equals(pp.params) {
+		return nil, errors.New("keys: key material was generated for different parameters")
+	}
+
+	sk := new(bfv.SecretKey)
+	if buff, payload, err = readWireBlob(payload); err != nil {
+		return nil, err
+	}
+	if err = sk.UnmarshalBinary(buff); err != nil {
+		return nil, err
+	}
+
+	if buff, payload, err = readWireBlob(payload); err != nil {
+		return nil, err
+	}
+	key, err := UnmarshalClientKey(buff)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) != 0 {
+		return nil, errors.New("keys: trailing bytes after key material")
+	}
+
+	return newClientFromKeys(pp, sk, key.pk, key.evk), nil
+}
+
+func newKeyFileCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	k, err := scrypt.Key([]byte(passphrase), salt, keyFileScryptN, keyFileScryptR, keyFileScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,243 @@
+package psm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Label identifies a server set. Metadata is optional.
+type Label struct {
+	ID       string
+	Metadata map[string]string
+}
+
+// LabeledSet is a server set with its label, see NewLabeledServer.
+type LabeledSet struct {
+	Label
+	Elements []uint64
+}
+
+// Security level of the label keys in bits
+const labelKeyBits = 128
+
+// Labels are sealed with AES-GCM. Every key seals one payload, so the nonce is fixed.
+var labelNonce = make([]byte, 12)
+
+// NewLabeledServer creates a server whose sets have a unique, non-empty ID.
+// Queries with WithLabels reveal the labels of the matching sets to the client (see Client.EvalLabels).
+func NewLabeledServer(pp *PSIParams, sets []LabeledSet, opts ...ServerOption) (*Server, error) {
+	raw := make([][]uint64, len(sets))
+	labels := make([]Label, len(sets))
+	ids := make(map[string]bool, len(sets))
+	for i, set := range sets {
+		if set.ID == "" {
+			return nil, fmt.Errorf("server set %v has an empty ID", i)
+		}
+		if ids[set.ID] {
+			return nil, fmt.Errorf("duplicate server set ID %q", set.ID)
+		}
+		ids[set.ID] = true
+		raw[i] = set.Elements
+		labels[i] = set.Label
+	}
+
+	sv, err := NewServer(pp, raw, opts...)
+	if err != nil {
+		return nil, err
+	}
+	sv.labels = labels
+	return sv, nil
+}
+
+// Labels are only defined for binary matching results of individual server sets.
+func checkLabelQuery(qt QueryType) error {
+	if !qt.WithLabels {
+		return nil
+	}
+	if qt.Matching != MATCHING_FPSM && qt.Matching != MATCHING_TVERSKY {
+		return errors.New("labels require f-psm or tversky matching")
+	}
+	if qt.Aggregation != AGGREGATION_NAIVE {
+		return errors.New("labels are not supported with aggregation")
+	}
+	return nil
+}
+
+// Number of slots (of log2(T) bits each) of a label key
+func labelKeySlots(pp *PSIParams) int {
+	slotBits := bits.Len64(pp.params.T()) - 1
+	return (labelKeyBits + slotBits - 1) / slotBits
+}
+
+// Seals the label of every server set under a fresh key that the client can only decrypt for matching sets.
+//
+// The result of a set is zero iff it matches. For every response ciphertext and each of the
+// labelKeySlots key slots, the server sends ctx*R + K with random non-zero R and random K:
+// the client decrypts K in the slots of matching sets and a random value in the other slots.
+func (sv *session) sealLabels(qt QueryType, ctxs []*bfv.Ciphertext) ([]*bfv.Ciphertext, [][]byte, error) {
+	params := sv.pp.params
+	N := int(params.N())
+	keySlots := labelKeySlots(sv.pp)
+
+	labelCtxs := make([]*bfv.Ciphertext, len(ctxs)*keySlots)
+	keys := make([][]uint64, len(sv.sets))
+	for n := range keys {
+		keys[n] = make([]uint64, keySlots)
+	}
+
+	err := sv.parallelFor(len(labelCtxs), func(evaluator bfv.Evaluator, encoder bfv.Encoder, i int) error {
+		k, j := i/keySlots, i%keySlots
+		key := GenRandomVector(params.N(), params.T(), true)
+		keyPtx := bfv.NewPlaintext(params)
+		encoder.EncodeUint(key, keyPtx)
+
+		labelCtxs[i] = evaluator.MulNew(ctxs[k], GenRandomPtx(params, false))
+		evaluator.Add(labelCtxs[i], keyPtx, labelCtxs[i])
+
+		for s, v := range rearrangeResp(sv.pp, qt, key) {
+			if n := k*N + s; n < len(keys) {
+				keys[n][j] = v
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Payloads are padded to the same length so that they do not leak the size of the labels
+	payloads := make([][]byte, len(sv.labels))
+	size := 0
+	for n, label := range sv.labels {
+		payloads[n] = encodeLabel(label)
+		if len(payloads[n]) > size {
+			size = len(payloads[n])
+		}
+	}
+	for n := range payloads {
+		payload := append(payloads[n], make([]byte, size-len(payloads[n]))...)
+		aead, err := labelAEAD(keys[n])
+		if err != nil {
+			return nil, nil, err
+		}
+		payloads[n] = aead.Seal(nil, labelNonce, payload, nil)
+	}
+	return labelCtxs, payloads, nil
+}
+
+// EvalLabels decrypts the labels of the server sets that match a query with WithLabels.
+// The labels are indexed by the position of their set in the server order, as in EvalResponse.
+func (cl *Client) EvalLabels(query *PsiQuery, resp *PsiResponse) (map[int]Label, error) {
+	if !query.queryType.WithLabels {
+		return nil, errors.New("the query does not request labels")
+	}
+	N := int(cl.pp.params.N())
+	keySlots := labelKeySlots(cl.pp)
+	if len(resp.labelCtxs) != len(resp.ctxs)*keySlots || len(resp.labels) != resp.serverSetNum {
+		return nil, errors.New("the response does not hold the labels of the server sets")
+	}
+
+	keys := make([][]uint64, resp.serverSetNum)
+	for n := range keys {
+		keys[n] = make([]uint64, keySlots)
+	}
+	for i, ctx := range resp.labelCtxs {
+		k, j := i/keySlots, i%keySlots
+		data := cl.encoder.DecodeUintNew(cl.decryptor.DecryptNew(ctx))
+		for s, v := range rearrangeResp(cl.pp, query.queryType, data) {
+			if n := k*N + s; n < len(keys) {
+				keys[n][j] = v
+			}
+		}
+	}
+
+	labels := make(map[int]Label)
+	for n, sealed := range resp.labels {
+		aead, err := labelAEAD(keys[n])
+		if err != nil {
+			return nil, err
+		}
+		// Only the payloads of the matching sets decrypt
+		payload, err := aead.Open(nil, labelNonce, sealed, nil)
+		if err != nil {
+			continue
+		}
+		label, err := decodeLabel(payload)
+		if err != nil {
+			return nil, err
+		}
+		labels[n] = label
+	}
+	return labels, nil
+}
+
+func labelAEAD(key []uint64) (cipher.AEAD, error) {
+	h := sha256.New()
+	var buff [8]byte
+	for _, v := range key {
+		binary.BigEndian.PutUint64(buff[:], v)
+		h.Write(buff[:])
+	}
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Labels use the wire encoding: the ID, the number of metadata entries, and the entries sorted by key.
+// Trailing bytes are padding.
+func encodeLabel(label Label) []byte {
+	keys := make([]string, 0, len(label.Metadata))
+	for k := range label.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	data := writeWireBlob(nil, []byte(label.ID))
+	data = writeWireUint(data, uint64(len(keys)))
+	for _, k := range keys {
+		data = writeWireBlob(data, []byte(k))
+		data = writeWireBlob(data, []byte(label.Metadata[k]))
+	}
+	return data
+}
+
+func decodeLabel(data []byte) (Label, error) {
+	var label Label
+	var id, k, v []byte
+	var num uint64
+	var err error
+	if id, data, err = readWireBlob(data); err != nil {
+		return label, err
+	}
+	if num, data, err = readWireUint(data); err != nil {
+		return label, err
+	}
+	// every entry takes at least two length prefixes
+	if num > uint64(len(data))/16 {
+		return label, errors.New("wire: invalid metadata count")
+	}
+	label.ID = string(id)
+	if num > 0 {
+		label.Metadata = make(map[string]string, num)
+	}
+	for i := uint64(0); i < num; i++ {
+		if k, data, err = readWireBlob(data); err != nil {
+			return label, err
+		}
+		if v, data, err = readWireBlob(data); err != nil {
+			return label, err
+		}
+		label.Metadata[string(k)] = string(v)
+	}
+	return label, nil
+}
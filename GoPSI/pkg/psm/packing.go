@@ -0,0 +1,124 @@
+package psm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// A small domain query packs PackedQueries client sets: the i-th block of the query holds
+// the (i mod PackedQueries)-th set. The server meets every batch of sdSetsPerCtx server sets
+// with its bit vectors rotated by 0 to PackedQueries-1 blocks within each row. A rotation of a
+// PlaintextMul is a permutation of its NTT coefficients, so the rotated batches come from the
+// (preprocessed) batches without encoding or rotation key. Block c of the rotation by t holds the
+// server set of block c+t of the batch, compared with the (c mod PackedQueries)-th packed set.
+// Number of client sets in a query
+func (qt QueryType) queryNum() int {
+	if qt.PackedQueries < 1 {
+		return 1
+	}
+	return qt.PackedQueries
+}
+
+// Packed queries run on small domain psi-ca without aggregation and labels.
+func checkPackedParams(qt QueryType, N, sdBitVecLen int) error {
+	if qt.PackedQueries < 0 {
+		return errors.New("the number of packed queries must be non-negative")
+	}
+	queryNum := qt.queryNum()
+	if queryNum == 1 {
+		return nil
+	}
+	if !qt.IsSmallDomain || qt.Psi != PSI_CA {
+		return errors.New("packed queries require small domain psi-ca")
+	}
+	if qt.Aggregation != AGGREGATION_NAIVE || qt.WithLabels {
+		return errors.New("packed queries support neither aggregation nor labels")
+	}
+	if queryNum&(queryNum-1) != 0 {
+		return fmt.Errorf("the number of packed queries %v is not a power of 2", queryNum)
+	}
+	// Each row must hold at least two copies of the packed sets for the duplicate check
+	if maxNum := N / 4 / sdBitVecLen; queryNum > maxNum {
+		return fmt.Errorf("%v packed queries exceed the %v supported by the parameters", queryNum, maxNum)
+	}
+	return nil
+}
+
+// Index in the collection of the server set of every block of a query packing n client sets,
+// -1 for the empty blocks of the last batch. Block p meets the (p mod n)-th client set.
+func packedOrder(pp *PSIParams, setNum, n int) []int {
+	rowBlocks := pp.sdSetsPerCtx / 2
+	batches := FitLen(setNum, pp.sdSetsPerCtx)
+	order := make([]int, 0, batches*n*pp.sdSetsPerCtx)
+	for k := 0; k < batches; k++ {
+		for t := 0; t < n; t++ {
+			for i := 0; i < pp.sdSetsPerCtx; i++ {
+				row, col := i/rowBlocks, i%rowBlocks
+				raw := k*pp.sdSetsPerCtx + row*rowBlocks + (col+t)%rowBlocks
+				if raw >= setNum {
+					raw = -1
+				}
+				order = append(order, raw)
+			}
+		}
+	}
+	return order
+}
+
+// Meets every set with each of the n packed client sets
+func (sv *session) packSets(n int) {
+	sv.setOrder(packedOrder(sv.pp, len(sv.raw_sets), n))
+	sv.packed = n
+}
+
+// Rotates the blocks of the bit vectors ptx by t blocks within each row
+func rotateBlocks(pp *PSIParams, ptx *bfv.PlaintextMul, t int) *bfv.PlaintextMul {
+	if t == 0 {
+		return ptx
+	}
+	rotated := bfv.NewPlaintextMul(pp.params)
+	ring.PermuteNTT(ptx.Value()[0], pp.params.GaloisElementForColumnRotationBy(t*pp.SdBitVecLen), rotated.Value()[0])
+	return rotated
+}
+
+// QueryBatch packs several small domain client sets into one query. The number of packed sets
+// is rounded up to a power of 2, and EvalBatchResponse decodes the results of every set.
+func (cl *Client) QueryBatch(sets [][]uint64, queryType QueryType) (*PsiQuery, error) {
+	if !queryType.IsSmallDomain {
+		return nil, errors.New("packed queries require the small domain")
+	}
+	if len(sets) == 0 {
+		return nil, errors.New("no client sets to query")
+	}
+	queryType.PackedQueries = NextPow2(len(sets))
+	return cl.query(sets, queryType)
+}
+
+// EvalBatchResponse returns the results of each packed client set, in the order of QueryBatch.
+// The results of a set are the ones EvalResponse returns for a query with that set only.
+func (cl *Client) EvalBatchResponse(clientSets [][]uint64, query *PsiQuery, resp *PsiResponse) ([][]uint64, error) {
+	queryNum := query.queryType.queryNum()
+	if len(clientSets) == 0 || len(clientSets) > queryNum {
+		return nil, fmt.Errorf("expected between 1 and %v client sets, got %v", queryNum, len(clientSets))
+	}
+
+	// Every server set meets every packed set in one block of the response
+	order := packedOrder(cl.pp, resp.serverSetNum, queryNum)
+	flat := cl.evalResponse(nil, query, &PsiResponse{serverSetNum: len(order), ctxs: resp.ctxs})
+	if len(flat) != len(order) {
+		return nil, errors.New("malformed packed response")
+	}
+	results := make([][]uint64, len(clientSets))
+	for j := range results {
+		results[j] = make([]uint64, resp.serverSetNum)
+	}
+	for p, n := range order {
+		if j := p % queryNum; n >= 0 && j < len(results) {
+			results[j][n] = flat[p]
+		}
+	}
+	return results, nil
+}
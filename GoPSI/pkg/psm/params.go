@@ -2,6 +2,7 @@ package psm
 
 import (
 	"fmt"
+	"math/bits"
 
 	"github.com/ldsec/lattigo/v2/bfv"
 )
@@ -16,6 +17,11 @@ type PSIParams struct {
 	// server set sizes must be smaller than clientExpansion
 	// clientPolyExpansion can be computed knowing N, ClRepNum, and maxClientElemPerCtx
 
+	// Server sets are hashed into ServerBins bins, each bin taking one replica of the query.
+	// Bins must be smaller than clientExpansion, which allows server sets up to ServerBins times larger.
+	ServerBins   int // must be in form of 2^k and divide ClRepNum
+	ldSetsPerCtx int
+
 	// small domain parameters
 	SdBitVecLen  int // must be in form of 2^k
 	sdSetsPerCtx int
@@ -29,6 +35,7 @@ func NewPSIParams(params *bfv.Parameters, rangeLim int) *PSIParams {
 	pp := &PSIParams{
 		params:              params,
 		ClRepNum:            1,
+		ServerBins:          1,
 		MaxClientElemPerCtx: 16,
 		SdBitVecLen:         256,
 	}
@@ -61,6 +68,43 @@ func NewPSIParams(params *bfv.Parameters, rangeLim int) *PSIParams {
 func (pp *PSIParams) Update() {
 	pp.ClientPolyExpansion = int(pp.params.N()) / pp.MaxClientElemPerCtx / pp.ClRepNum
 	pp.sdSetsPerCtx = int(pp.params.N()) / pp.SdBitVecLen
+	if pp.ServerBins > 0 {
+		pp.ldSetsPerCtx = pp.ClRepNum / pp.ServerBins
+	}
+}
+
+func (pp *PSIParams) checkServerBins() error {
+	if pp.ServerBins < 1 || pp.ServerBins&(pp.ServerBins-1) != 0 || pp.ldSetsPerCtx*pp.ServerBins != pp.ClRepNum {
+		return fmt.Errorf("the number of server bins (%v) must be a power of 2 dividing ClRepNum (%v)", pp.ServerBins, pp.ClRepNum)
+	}
+	return nil
+}
+
+// Bin of a large domain element, see ServerBins
+func (pp *PSIParams) serverBin(x uint64) int {
+	if pp.ServerBins == 1 {
+		return 0
+	}
+	// Fibonacci hashing: the top bits of x * 2^64/phi
+	return int((x * 0x9E3779B97F4A7C15) >> (64 - uint(bits.Len(uint(pp.ServerBins))-1)))
+}
+
+// Splits a large domain set by bin
+func (pp *PSIParams) binSet(set []uint64) [][]uint64 {
+	bins := make([][]uint64, pp.ServerBins)
+	for _, x := range set {
+		b := pp.serverBin(x)
+		bins[b] = append(bins[b], x)
+	}
+	return bins
+}
+
+// Number of ciphertexts of a large domain query with setSize elements
+func (pp *PSIParams) queryCtxNum(setSize int) int {
+	if setSize == 0 {
+		return 1
+	}
+	return FitLen(setSize, pp.MaxClientElemPerCtx)
 }
 
 func (pp *PSIParams) Describe() string {
@@ -68,6 +112,9 @@ func (pp *PSIParams) Describe() string {
 	desc += fmt.Sprintf("Number of query replicates in the ciphertext: %v\n", pp.ClRepNum)
 	desc += fmt.Sprintf("Small domain => SdBitVecLen: %v\n", pp.SdBitVecLen)
 	desc += fmt.Sprintf("Small input  => Max client element per ctx: %v, max server size: %v", pp.MaxClientElemPerCtx, pp.ClientPolyExpansion)
+	if pp.ServerBins > 1 {
+		desc += fmt.Sprintf(" per bin, %v bins", pp.ServerBins)
+	}
 	return desc
 }
 
@@ -86,6 +133,41 @@ func GetBFVParam(logn int) (params *bfv.Parameters) {
 	return params
 }
 
+// Multiplicative depth supported by the presets of GetBFVParam (measured with testDepth).
+// Note that plaintext multiplications also consume part of the noise budget.
+var presetDepth = map[int]int{
+	12: 1,
+	13: 2,
+	14: 7,
+	15: 16,
+}
+
+// GetFermatBFVParam returns the preset for exact equality tests (see IsZero).
+// T = 2^16+1, so x^(T-1) only takes 16 squarings. Smaller N do not support this depth.
+func GetFermatBFVParam() *bfv.Parameters {
+	return bfv.DefaultParams[bfv.PN15QP880].WithT(65537)
+}
+
+// Measured with testDepth, as presetDepth
+const fermatPresetDepth = 17
+
+// MaxDepth returns the multiplicative depth supported by the parameters, or -1 if unknown.
+// A smaller plaintext modulus on the ring of a preset (see PlanParams) adds less noise, so it
+// supports at least the depth of the preset.
+func (pp *PSIParams) MaxDepth() int {
+	if GetFermatBFVParam().Equals(pp.params) {
+		return fermatPresetDepth
+	}
+	logn := int(pp.params.LogN())
+	if depth, ok := presetDepth[logn]; ok {
+		preset := GetBFVParam(logn)
+		if pp.params.T() <= preset.T() && preset.WithT(pp.params.T()).Equals(pp.params) {
+			return depth
+		}
+	}
+	return -1
+}
+
 // function taken from lattigo samples
 func DescribeParams(params *bfv.Parameters) {
 	fmt.Println("================== Parameters ==================")
@@ -0,0 +1,355 @@
+package psm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Workload describes the inputs a deployment has to support.
+type Workload struct {
+	QueryType        QueryType
+	ClientSetSize    int    // maximum number of elements in a client set
+	MaxServerSetSize int    // maximum number of elements in a server set
+	CollectionSize   int    // number of server sets
+	Domain           uint64 // elements are in [0, Domain)
+}
+
+// ParamPlan is a parameter choice for a workload, see PlanParams.
+type ParamPlan struct {
+	LogN int
+	T    uint64
+
+	MaxClientElemPerCtx int
+	ClRepNum            int
+	ServerBins          int
+	SdBitVecLen         int
+	RangeLim            int
+
+	Depth            int // multiplicative depth of the query
+	MaxDepth         int // multiplicative depth supported by the BFV parameters
+	Ciphertexts      int // number of server ciphertexts the server evaluates
+	QueryCiphertexts int // number of ciphertexts of a client query
+
+	// Reasons for the choice, including why smaller parameters were rejected.
+	Explanation []string
+}
+
+// Default range limit of the framework (see NewPSIParams)
+const planRangeLim = 128
+
+// Log2 of the probability that a bin of the collection overflows, see binCapacity
+const planBinOverflowLog2 = -40
+
+// Log2 of the smallest plaintext modulus of a plan: the randomized zero tests of the matching
+// layers give a false match with probability about 1/T.
+const planMinTLog2 = 15
+
+// PlanParams returns parameters for the workload: the ring of the first preset of GetBFVParam
+// (N=2^12 to 2^15) whose multiplicative depth supports the query, with the smallest NTT-friendly
+// prime T from 2^planMinTLog2 that holds the values of the query (large domain elements, Tversky
+// and similarity scores), and the packing parameters sized for the workload. T is at most the one
+// of the preset, so the parameters support at least its depth. In the large domain, it hashes
+// server sets into ServerBins bins when that shrinks the polynomials without adding server
+// ciphertexts, with bins large enough that one overflows with probability below 2^planBinOverflowLog2.
+func PlanParams(w Workload) (*ParamPlan, error) {
+	if w.ClientSetSize < 1 || w.MaxServerSetSize < 0 || w.CollectionSize < 1 || w.Domain < 1 {
+		return nil, errors.New("invalid workload")
+	}
+	if err := checkQueryType(w.QueryType); err != nil {
+		return nil, err
+	}
+
+	explanation := []string{}
+	for _, logn := range []int{12, 13, 14, 15} {
+		plan, err := planForPreset(w, logn)
+		if err != nil {
+			explanation = append(explanation, fmt.Sprintf("N=2^%v rejected: %v", logn, err))
+			continue
+		}
+		plan.Explanation = append(explanation, plan.Explanation...)
+		return plan, nil
+	}
+	return nil, fmt.Errorf("no BFV preset supports the workload:\n%v", strings.Join(explanation, "\n"))
+}
+
+func planForPreset(w Workload, logn int) (*ParamPlan, error) {
+	params := GetBFVParam(logn)
+	N := int(params.N())
+	plan := &ParamPlan{
+		LogN:                logn,
+		T:                   params.T(),
+		MaxClientElemPerCtx: 16,
+		ClRepNum:            1,
+		ServerBins:          1,
+		SdBitVecLen:         256,
+		RangeLim:            planRangeLim,
+		QueryCiphertexts:    1,
+		MaxDepth:            presetDepth[logn],
+	}
+	qt := w.QueryType
+
+	// Both malicious checks multiply two ciphertexts and randomize the product with a plaintext.
+	// The presets measure the depth with ciphertext squarings only, hence the extra level.
+	plan.Depth = 2
+
+	if qt.IsSmallDomain {
+		// Each row must hold at least two copies of the bit vector for the duplicate check
+		plan.SdBitVecLen = NextPow2(int(w.Domain))
+		if 2*plan.SdBitVecLen > N/2 {
+			return nil, fmt.Errorf("the domain %v does not fit twice in a row of %v slots", w.Domain, N/2)
+		}
+		// The range check of the matching compares values below the range limit
+		rangeLim, err := matchingRangeLim(qt)
+		if err != nil {
+			return nil, err
+		}
+		if rangeLim > plan.RangeLim {
+			plan.RangeLim = rangeLim
+		}
+	}
+	// The depth of the whole query is checked below
+	T, err := planPlaintextModulus(N, params.T(), func(T uint64) error {
+		// Elements are interpolated modulo T
+		if !qt.IsSmallDomain && w.Domain > T {
+			return fmt.Errorf("the domain %v exceeds the plaintext modulus %v", w.Domain, T)
+		}
+		return checkQueryLimits(qt, queryLimits{N, T, plan.SdBitVecLen, plan.RangeLim, -1})
+	})
+	if err != nil {
+		return nil, err
+	}
+	plan.T = T
+	plan.explain("plaintext modulus: T=%v, the smallest NTT-friendly prime from 2^%v for the query", T, planMinTLog2)
+
+	if qt.IsSmallDomain {
+		setsPerCtx := N / plan.SdBitVecLen / qt.queryNum()
+		plan.Ciphertexts = FitLen(w.CollectionSize, setsPerCtx)
+		plan.explain("small domain: bit vectors of length %v, %v server sets per ciphertext",
+			plan.SdBitVecLen, setsPerCtx)
+		if qt.queryNum() > 1 {
+			plan.explain("packing: %v client sets per query", qt.queryNum())
+		}
+
+		if qt.Matching == MATCHING_TVERSKY {
+			scoreLim, _ := qt.Tversky.ScoreLimit()
+			if depth := tverskyDepth(qt, scoreLim); depth > plan.Depth {
+				plan.Depth = depth
+			}
+			plan.explain("tversky: range check on scores in [0, %v)", scoreLim)
+		}
+		if isBatchedSDMatching(qt.Matching) {
+			depth := 0
+			if qt.Matching == MATCHING_HAMMING {
+				depth = hammingDepth(qt)
+				plan.explain("hamming: range check on distances in [0, %v]", qt.HammingRadius)
+			} else if isSimilarityMetric(qt.Matching) {
+				scoreLim, _ := similarityScoreLimit(qt.Matching, qt.Similarity)
+				depth = similarityDepth(qt, scoreLim)
+				plan.explain("similarity: range check on scores in [0, %v)", scoreLim)
+			}
+			if qt.Aggregation == AGGREGATION_X_MS {
+				// randomizeBatchedResults and the product tree of aggregateFPSM
+				ctxNum := FitLen(w.CollectionSize, N)
+				depth += 1 + plan.batchLayout(params, qt, w.CollectionSize).depth(ctxNum)
+				plan.explain("x-ms: product of the f-psm results of %v server sets in %v ciphertexts", w.CollectionSize, ctxNum)
+			}
+			if depth > plan.Depth {
+				plan.Depth = depth
+			}
+		}
+	} else {
+		// Server sets, or their bins, must be smaller than ClientPolyExpansion.
+		// The remaining slots hold replicas of the query to evaluate several server sets per ciphertext.
+		// Bins do not save ciphertexts, as a set takes ServerBins replicas, but for the same number
+		// of ciphertexts they shrink the polynomials: the interpolation and its rotations are cheaper.
+		var best *largeDomainPacking
+		for bins := 1; bins <= N/2; bins *= 2 {
+			packing := planLargeDomainPacking(w, N, bins)
+			if packing == nil {
+				continue
+			}
+			if best == nil || packing.ciphertexts < best.ciphertexts ||
+				packing.ciphertexts == best.ciphertexts && packing.expansion < best.expansion {
+				best = packing
+			}
+		}
+		if best == nil {
+			return nil, fmt.Errorf("server sets of %v elements do not fit in rows of %v slots, even with bins", w.MaxServerSetSize, N/2)
+		}
+		plan.MaxClientElemPerCtx = best.maxClientElemPerCtx
+		plan.ClRepNum = best.clRepNum
+		plan.ServerBins = best.bins
+		plan.QueryCiphertexts = FitLen(w.ClientSetSize, plan.MaxClientElemPerCtx)
+		plan.Ciphertexts = best.ciphertexts
+		if plan.ServerBins > 1 {
+			plan.explain("bins: server sets hashed into %v bins of at most %v elements, overflow probability below 2^%v",
+				plan.ServerBins, best.expansion-1, planBinOverflowLog2)
+		}
+		plan.explain("large domain: %v client elements of degree %v, %v server sets per ciphertext, %v query ciphertexts",
+			plan.MaxClientElemPerCtx, best.expansion-1, plan.ClRepNum/plan.ServerBins, plan.QueryCiphertexts)
+
+		if qt.Matching == MATCHING_FPSM && qt.Aggregation == AGGREGATION_X_MS {
+			// evalFPSM sums the indicators and randomizes them with a plaintext.
+			// aggregateFPSM multiplies the results of all the server sets.
+			ctxNum := FitLen(w.CollectionSize, N)
+			if depth := 1 + plan.batchLayout(params, qt, w.CollectionSize).depth(ctxNum); depth > plan.Depth {
+				plan.Depth = depth
+			}
+			plan.explain("x-ms: product of the f-psm results of %v server sets in %v ciphertexts", w.CollectionSize, ctxNum)
+		}
+	}
+
+	if qt.Aggregation == AGGREGATION_TH_MS {
+		// The range check of tversky is followed by the product tree of aggregateThreshold,
+		// the selection of the set slots, and the randomization
+		depth := plan.batchLayout(params, qt, w.CollectionSize).depth(FitLen(w.CollectionSize, N)) + 2
+		if qt.IsSmallDomain && qt.Matching == MATCHING_TVERSKY {
+			scoreLim, _ := qt.Tversky.ScoreLimit()
+			depth += tverskyDepth(qt, scoreLim)
+		}
+		if depth > plan.Depth {
+			plan.Depth = depth
+		}
+		plan.explain("th-ms: product of the results of %v server sets modulo z^%v", w.CollectionSize, qt.Threshold)
+	}
+
+	if qt.WithLabels {
+		// The label keys randomize the response with a plaintext
+		plan.Depth++
+		plan.explain("labels: one more plaintext multiplication")
+	}
+
+	if plan.Depth > plan.MaxDepth {
+		return nil, fmt.Errorf("the query requires depth %v but the parameters only support %v", plan.Depth, plan.MaxDepth)
+	}
+	plan.explain("N=2^%v, T=%v: depth %v of %v, %v server ciphertexts", logn, plan.T, plan.Depth, plan.MaxDepth, plan.Ciphertexts)
+	return plan, nil
+}
+
+// Smallest prime T = 1 mod 2N (which batches N slots) in [2^planMinTLog2, maxT] that fits the query.
+// maxT must be such a prime.
+func planPlaintextModulus(N int, maxT uint64, fits func(T uint64) error) (uint64, error) {
+	step := uint64(2 * N)
+	for T := (uint64(1)<<planMinTLog2+step-2)/step*step + 1; T < maxT; T += step {
+		if big.NewInt(int64(T)).ProbablyPrime(0) && fits(T) == nil {
+			return T, nil
+		}
+	}
+	if err := fits(maxT); err != nil {
+		return 0, err
+	}
+	return maxT, nil
+}
+
+// Range limit of the range check of a small domain matching, 0 without range check
+func matchingRangeLim(qt QueryType) (int, error) {
+	switch {
+	case qt.Matching == MATCHING_TVERSKY || qt.Matching == MATCHING_TVERSKY_PLAIN:
+		return qt.Tversky.ScoreLimit()
+	case qt.Matching == MATCHING_HAMMING:
+		return qt.HammingRadius + 1, nil
+	case isSimilarityMetric(qt.Matching):
+		return similarityScoreLimit(qt.Matching, qt.Similarity)
+	}
+	return 0, nil
+}
+
+// Layout of the batched responses of the plan
+func (plan *ParamPlan) batchLayout(params *bfv.Parameters, qt QueryType, setNum int) *batchLayout {
+	pp := &PSIParams{
+		params:              params,
+		MaxClientElemPerCtx: plan.MaxClientElemPerCtx,
+		ClRepNum:            plan.ClRepNum,
+		ServerBins:          plan.ServerBins,
+		SdBitVecLen:         plan.SdBitVecLen,
+	}
+	pp.Update()
+	return newBatchLayout(pp, qt, setNum)
+}
+
+// Large domain packing of a plan
+type largeDomainPacking struct {
+	bins                int
+	maxClientElemPerCtx int
+	clRepNum            int
+	expansion           int // ClientPolyExpansion
+	ciphertexts         int // number of server ciphertexts
+}
+
+// Packing of the workload with the given number of server bins, nil if the server sets do not fit
+func planLargeDomainPacking(w Workload, N, bins int) *largeDomainPacking {
+	capacity := w.MaxServerSetSize
+	if bins > 1 {
+		capacity = binCapacity(w.MaxServerSetSize, bins, bins*w.CollectionSize)
+	}
+	expansion := NextPow2(capacity + 1)
+	if 2*expansion > N {
+		return nil
+	}
+
+	maxClientElemPerCtx := NextPow2(w.ClientSetSize)
+	if maxClientElemPerCtx < 2 {
+		maxClientElemPerCtx = 2
+	}
+	if maxClientElemPerCtx*expansion*bins > N {
+		// Larger client sets are split across several query ciphertexts.
+		// Each server set takes one replica per bin.
+		maxClientElemPerCtx = N / expansion / bins
+		if maxClientElemPerCtx < 2 {
+			return nil
+		}
+	}
+	clRepNum := N / maxClientElemPerCtx / expansion
+	return &largeDomainPacking{
+		bins:                bins,
+		maxClientElemPerCtx: maxClientElemPerCtx,
+		clRepNum:            clRepNum,
+		expansion:           expansion,
+		ciphertexts:         FitLen(w.CollectionSize, clRepNum/bins) * FitLen(w.ClientSetSize, maxClientElemPerCtx),
+	}
+}
+
+// Smallest bin size such that, when binNum sets of size elements are each hashed into bins bins,
+// one of the binNum bins overflows with probability below 2^planBinOverflowLog2 (union bound).
+func binCapacity(size, bins, binNum int) int {
+	// Sums the tail of the binomial distribution from the largest loads down
+	p := 1 / float64(bins)
+	limit := math.Exp2(planBinOverflowLog2) / float64(binNum)
+	tail := 0.0
+	for c := size - 1; c >= 0; c-- {
+		// Probability of c+1 elements in a bin
+		k := float64(c + 1)
+		lgSize, _ := math.Lgamma(float64(size) + 1)
+		lgK, _ := math.Lgamma(k + 1)
+		lgRest, _ := math.Lgamma(float64(size) - k + 1)
+		tail += math.Exp(lgSize - lgK - lgRest + k*math.Log(p) + (float64(size)-k)*math.Log1p(-p))
+		if tail >= limit {
+			return c + 1
+		}
+	}
+	return 0
+}
+
+func (plan *ParamPlan) explain(format string, args ...interface{}) {
+	plan.Explanation = append(plan.Explanation, fmt.Sprintf(format, args...))
+}
+
+// NewPSIParams builds the framework parameters of the plan.
+func (plan *ParamPlan) NewPSIParams() *PSIParams {
+	pp := NewPSIParams(GetBFVParam(plan.LogN).WithT(plan.T), plan.RangeLim)
+	pp.MaxClientElemPerCtx = plan.MaxClientElemPerCtx
+	pp.ClRepNum = plan.ClRepNum
+	pp.ServerBins = plan.ServerBins
+	pp.SdBitVecLen = plan.SdBitVecLen
+	pp.Update()
+	return pp
+}
+
+func (plan *ParamPlan) Describe() string {
+	return strings.Join(plan.Explanation, "\n")
+}
@@ -0,0 +1,144 @@
+package psm
+
+import (
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Preprocessing moves the deterministic encoding of the collection out of the queries:
+//   - small domain: the bit vectors of every batch of sdSetsPerCtx server sets, as PlaintextMul
+//     (NTT and Montgomery form), ready for the multiplication in computePSI_CA_SD. Packed queries
+//     rotate the cached batches (see rotateBlocks).
+//   - large domain: the polynomial of every bin of every server set, whose roots are the bin
+//     elements, in any order of the sets.
+//
+// Two encodings still run at query time. Shuffled queries (ca-ms, th-ms) encode their batches:
+// the automorphisms of a plaintext reach N of the permutations of its blocks, not a uniform
+// shuffle of the sets. Large domain queries encode their polynomials: every block of
+// coefficients is multiplied by its own fresh random value (MultPlainPloyWithRand), which an
+// encoded plaintext cannot take without another encoding.
+
+// Preprocess builds the plaintexts of the collection for small or large domain queries.
+// In the large domain, it fails with the index of a server set with a bin of
+// ClientPolyExpansion elements or more. It waits for the running queries before replacing the
+// cache. The small domain cache takes the memory of one PlaintextMul per N/SdBitVecLen server sets.
+func (sv *Server) Preprocess(smallDomain bool) error {
+	// Preprocessing runs on the workers of a session without key (and evaluators)
+	s := &session{Server: sv, sets: sv.raw_sets}
+	workers := sv.workers
+	if workers < 1 {
+		workers = 1
+	}
+	s.evaluators = make([]bfv.Evaluator, workers)
+	s.encoders = make([]bfv.Encoder, workers)
+	for w := range s.encoders {
+		s.encoders[w] = bfv.NewEncoder(sv.pp.params)
+	}
+	s.encoder = s.encoders[0]
+
+	if smallDomain {
+		ptxs := make([]*bfv.PlaintextMul, FitLen(len(sv.raw_sets), sv.pp.sdSetsPerCtx))
+		err := s.parallelFor(len(ptxs), func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
+			var err error
+			ptxs[k], err = encodeBitVectors(sv.pp, encoder, sv.raw_sets, k)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		sv.mu.Lock()
+		sv.bitVecPtxs = ptxs
+		sv.mu.Unlock()
+		return nil
+	}
+
+	polys := make([][][]uint64, len(sv.raw_sets))
+	err := s.parallelFor(len(polys), func(evaluator bfv.Evaluator, encoder bfv.Encoder, n int) error {
+		var err error
+		polys[n], err = interpolateBins(sv.pp, n, sv.raw_sets[n])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sv.mu.Lock()
+	sv.binPolys = polys
+	sv.mu.Unlock()
+	return nil
+}
+
+// Bit vectors of the k-th batch of server sets
+func (sv *session) bitVectorPtx(encoder bfv.Encoder, k int) (*bfv.PlaintextMul, error) {
+	if sv.packed > 1 {
+		// The k-th batch is the batch k/packed of the collection, rotated by k%packed blocks
+		ptx, err := sv.rawBitVectorPtx(encoder, k/sv.packed)
+		if err != nil {
+			return nil, err
+		}
+		return rotateBlocks(sv.pp, ptx, k%sv.packed), nil
+	}
+	if sv.order == nil {
+		return sv.rawBitVectorPtx(encoder, k)
+	}
+	return encodeBitVectors(sv.pp, encoder, sv.sets, k)
+}
+
+// Bit vectors of the k-th batch of the collection
+func (sv *session) rawBitVectorPtx(encoder bfv.Encoder, k int) (*bfv.PlaintextMul, error) {
+	if sv.bitVecPtxs != nil {
+		return sv.bitVecPtxs[k], nil
+	}
+	return encodeBitVectors(sv.pp, encoder, sv.raw_sets, k)
+}
+
+func encodeBitVectors(pp *PSIParams, encoder bfv.Encoder, sets [][]uint64, k int) (*bfv.PlaintextMul, error) {
+	bitVec := make([]uint64, pp.params.N())
+	next := (k + 1) * pp.sdSetsPerCtx
+	if next > len(sets) {
+		next = len(sets)
+	}
+	if err := EncodeSetsAsBitVector(sets[k*pp.sdSetsPerCtx:next], pp.SdBitVecLen, bitVec); err != nil {
+		return nil, err
+	}
+
+	ptx := bfv.NewPlaintextMul(pp.params)
+	encoder.EncodeUintMul(bitVec, ptx)
+	return ptx, nil
+}
+
+// Polynomials of the bins of the n-th server set
+func (sv *session) setPolys(n int) ([][]uint64, error) {
+	if sv.binPolys != nil {
+		return sv.binPolys[sv.rawIndex(n)], nil
+	}
+	return interpolateBins(sv.pp, sv.rawIndex(n), sv.sets[n])
+}
+
+// Interpolates the bins of the server set of index n in the collection
+func interpolateBins(pp *PSIParams, n int, set []uint64) ([][]uint64, error) {
+	if err := checkLargeDomainSet(pp, set); err != nil {
+		return nil, fmt.Errorf("server set %v: %v", n, err)
+	}
+	bins := [][]uint64{set}
+	if pp.ServerBins > 1 {
+		bins = pp.binSet(set)
+	}
+
+	polys := make([][]uint64, len(bins))
+	for i, bin := range bins {
+		if len(bin) > pp.ClientPolyExpansion-1 {
+			if pp.ServerBins > 1 {
+				return nil, fmt.Errorf("server set %v: bin %v has %v elements, more than the %v of a bin", n, i, len(bin), pp.ClientPolyExpansion-1)
+			}
+			return nil, fmt.Errorf("server set %v has %v elements, more than the %v of a server set", n, len(bin), pp.ClientPolyExpansion-1)
+		}
+
+		// Note:
+		// Interpolation works as: a[0]*1 + a[1]*x + a[2]*x^2 ...
+		// Client packs input as: c, c^2, c^3, ...
+		// The starting difference 1 vs c acts as adding (x == 0) to roots
+		polys[i] = InterpolateFromRoots(pp, bin)
+	}
+	return polys, nil
+}
@@ -0,0 +1,88 @@
+package psm
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	mrand "math/rand"
+	"sync"
+)
+
+// RandomSource provides the randomness used to mask and shuffle protocol values.
+// Implementations must be safe for concurrent use.
+type RandomSource interface {
+	Uint64() uint64
+}
+
+// RandSource is the randomness used by the protocol (masking, randomization, and shuffling).
+// It defaults to a cryptographically secure source. Only replace it with a seeded source for testing.
+var RandSource RandomSource = NewCryptoSource()
+
+type cryptoSource struct {
+	lock   sync.Mutex
+	reader *bufio.Reader
+}
+
+// NewCryptoSource returns a source reading from the operating system CSPRNG (crypto/rand).
+func NewCryptoSource() RandomSource {
+	return &cryptoSource{reader: bufio.NewReaderSize(rand.Reader, 4096)}
+}
+
+func (src *cryptoSource) Uint64() uint64 {
+	var buff [8]byte
+	src.lock.Lock()
+	_, err := io.ReadFull(src.reader, buff[:])
+	src.lock.Unlock()
+	if err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(buff[:])
+}
+
+type seededSource struct {
+	lock sync.Mutex
+	rng  *mrand.Rand
+}
+
+// NewSeededSource returns a deterministic, insecure source for tests.
+// Note that the sequence is shared between server workers, so outputs are only
+// reproducible when the server runs with a single worker.
+func NewSeededSource(seed int64) RandomSource {
+	return &seededSource{rng: mrand.New(mrand.NewSource(seed))}
+}
+
+func (src *seededSource) Uint64() uint64 {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+	return src.rng.Uint64()
+}
+
+// Uniform element of [0, max) without modulo bias
+func randUint64n(max uint64) uint64 {
+	// reject the values below 2^64 mod max so that the remaining range is a multiple of max
+	threshold := -max % max
+	for {
+		if v := RandSource.Uint64(); v >= threshold {
+			return v % max
+		}
+	}
+}
+
+// Uniform element of [1, max)
+func randNonZero(max uint64) uint64 {
+	return randUint64n(max-1) + 1
+}
+
+// Uniform permutation of [0, n) (Fisher-Yates)
+func randPerm(n int) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	for i := n - 1; i > 0; i-- {
+		j := int(randUint64n(uint64(i + 1)))
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	return perm
+}
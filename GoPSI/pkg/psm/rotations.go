@@ -0,0 +1,209 @@
+package psm
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Collects the rotations performed by the server while answering a query.
+// Must be kept in sync with Server.Respond and the SIMD operations it uses.
+type rotationPlan struct {
+	pp      *PSIParams
+	columns map[int]bool
+	rowSwap bool
+}
+
+func newRotationPlan(pp *PSIParams) *rotationPlan {
+	return &rotationPlan{pp: pp, columns: make(map[int]bool)}
+}
+
+func (plan *rotationPlan) rowN() int {
+	return int(plan.pp.params.N()) / 2
+}
+
+// RotateColumns(k)
+func (plan *rotationPlan) column(k int) {
+	k = int(Mod(k, plan.rowN()))
+	if k != 0 {
+		plan.columns[k] = true
+	}
+}
+
+// Rotations by 2^k in [start, finish) (SumSIMD, ProdSIMD, SIMDOperation, LinearBatch)
+func (plan *rotationPlan) pow2Range(start, finish int) {
+	for shift := start; shift < finish; shift *= 2 {
+		plan.column(shift)
+	}
+}
+
+// ExtendedRotate(rot)
+func (plan *rotationPlan) extended(rot int) {
+	rot = int(Mod(rot, plan.rowN()))
+	for k := 1; rot > 0; k *= 2 {
+		if rot%2 == 1 {
+			plan.column(k)
+		}
+		rot /= 2
+	}
+}
+
+// ExtendedRotate with a rotation only known at query time
+func (plan *rotationPlan) anyExtended() {
+	plan.pow2Range(1, plan.rowN())
+}
+
+// sumAllSlots only requires the rotations by powers of 4 and the row swap
+func (plan *rotationPlan) sumAllSlots() {
+	for shift := 1; shift < plan.rowN(); shift *= 4 {
+		plan.column(shift)
+	}
+	plan.rowSwap = true
+}
+
+func (plan *rotationPlan) galoisElements() []uint64 {
+	params := plan.pp.params
+	galEls := make([]uint64, 0, len(plan.columns)+1)
+	for k := range plan.columns {
+		galEls = append(galEls, params.GaloisElementForColumnRotationBy(k))
+	}
+	if plan.rowSwap {
+		galEls = append(galEls, params.GaloisElementForRowRotation())
+	}
+	sort.Slice(galEls, func(i, j int) bool { return galEls[i] < galEls[j] })
+	return galEls
+}
+
+func (plan *rotationPlan) addQuery(qt QueryType) {
+	pp := plan.pp
+	rowN := plan.rowN()
+
+	if qt.Aggregation == AGGREGATION_TH_MS {
+		// aggregateThreshold
+		plan.anyExtended()
+		plan.pow2Range(batchStride(pp, qt), rowN)
+		plan.rowSwap = true
+	}
+
+	if qt.IsSmallDomain {
+		// computePSI_CA_SD and computeTversky
+		plan.pow2Range(1, pp.SdBitVecLen)
+		// BatchSIMDctxs rotates the i-th ctx of each batch by i < SdBitVecLen
+		plan.pow2Range(1, pp.SdBitVecLen)
+		if qt.Matching == MATCHING_TVERSKY && qt.Aggregation == AGGREGATION_X_MS {
+			// aggregateTversky
+			plan.pow2Range(256, 64*256)
+		}
+		if isBatchedSDMatching(qt.Matching) && qt.Aggregation == AGGREGATION_X_MS {
+			// aggregateFPSM
+			plan.anyExtended()
+			plan.pow2Range(pp.SdBitVecLen, rowN)
+		}
+
+		// sdMaliciousCheck
+		plan.column(qt.queryNum() * pp.SdBitVecLen)
+		plan.sumAllSlots()
+		return
+	}
+
+	// interpolationPSI
+	plan.pow2Range(1, pp.ClientPolyExpansion)
+	if qt.Psi == PSI_CA {
+		// shuffleIntersectionIndicators
+		half := pp.MaxClientElemPerCtx * pp.ServerBins / 2
+		for d := -(half - 1); d < half; d++ {
+			plan.extended(d * pp.ClientPolyExpansion)
+		}
+		plan.rowSwap = true
+	}
+	if qt.Matching == MATCHING_FPSM {
+		batchSize := rowN / pp.ldSetsPerCtx
+		// evalFPSM
+		plan.pow2Range(pp.ClientPolyExpansion, batchSize)
+		// batchPSMresps
+		plan.pow2Range(1, batchSize)
+		plan.rowSwap = true
+		if qt.Aggregation == AGGREGATION_X_MS {
+			// aggregateFPSM
+			plan.anyExtended()
+			plan.pow2Range(batchSize, rowN)
+		}
+	}
+
+	// PolynomialMaliciousCheck
+	plan.extended(pp.ClientPolyExpansion - 1)
+	plan.pow2Range(1, pp.ClientPolyExpansion)
+	plan.column(-1)
+	if pp.ldSetsPerCtx > 1 {
+		plan.column(rowN / pp.ldSetsPerCtx)
+	}
+	plan.sumAllSlots()
+}
+
+// Column rotations by powers of 2 for which a client key has a rotation key (nil for all of them)
+type keyRotations map[int]bool
+
+func newKeyRotations(pp *PSIParams, evk *bfv.EvaluationKey) keyRotations {
+	rots := make(keyRotations)
+	if evk.Rtks == nil {
+		return rots
+	}
+	for k := 1; k < int(pp.params.N())/2; k *= 2 {
+		if _, ok := evk.Rtks.Keys[pp.params.GaloisElementForColumnRotationBy(k)]; ok {
+			rots[k] = true
+		}
+	}
+	return rots
+}
+
+// Rotates the columns by k = 2^i. Without a key for k, the rotation is composed of two rotations by k/2.
+func (rots keyRotations) rotateColumns(evaluator bfv.Evaluator, ctx *bfv.Ciphertext, k int, out *bfv.Ciphertext) {
+	if rots == nil || rots[k] || k == 1 {
+		evaluator.RotateColumns(ctx, k, out)
+		return
+	}
+	rots.rotateColumns(evaluator, ctx, k/2, out)
+	rots.rotateColumns(evaluator, out, k/2, out)
+}
+
+// Computes the sum of all the slots in every slot, as SIMDOperation over a full row with combineRow.
+// It runs with the rotations of the key, which include at least the powers of 4 (see rotationPlan.sumAllSlots).
+func sumAllSlots(pp *PSIParams, evaluator bfv.Evaluator, ctx *bfv.Ciphertext, rots keyRotations) *bfv.Ciphertext {
+	tmp := ctx.CopyNew().Ciphertext()
+	ctx = tmp.CopyNew().Ciphertext()
+
+	for shift := 1; shift < int(pp.params.N())/2; shift *= 2 {
+		rots.rotateColumns(evaluator, ctx, shift, tmp)
+		evaluator.Add(ctx, tmp, ctx)
+	}
+	evaluator.RotateRows(ctx, tmp)
+	evaluator.Add(ctx, tmp, ctx)
+	return ctx
+}
+
+// RequiredGaloisElements returns the Galois elements of the rotation keys used by the server
+// to answer queries of the given types.
+func RequiredGaloisElements(pp *PSIParams, queryTypes ...QueryType) []uint64 {
+	plan := newRotationPlan(pp)
+	for _, qt := range queryTypes {
+		plan.addQuery(qt)
+	}
+	return plan.galoisElements()
+}
+
+// Checks that the evaluation key contains the rotation keys required by a query.
+func checkRotationKeys(pp *PSIParams, qt QueryType, evk *bfv.EvaluationKey) error {
+	missing := 0
+	for _, galEl := range RequiredGaloisElements(pp, qt) {
+		if evk.Rtks == nil {
+			missing++
+		} else if _, ok := evk.Rtks.Keys[galEl]; !ok {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("client key lacks %v rotation keys required by the query", missing)
+	}
+	return nil
+}
@@ -2,66 +2,221 @@ package psm
 
 import (
 	"errors"
-	"math/rand"
+	"fmt"
+	"runtime"
+	"sync"
 
 	"github.com/ldsec/lattigo/v2/bfv"
 	"github.com/schollz/progressbar/v3"
 )
 
-type server struct {
-	pp      *PSIParams
-	encoder bfv.Encoder
-	N       int
+// Server holds the preprocessed collection. Its sets are read-only after its creation, Preprocess
+// swaps its cache under a lock, and every query is answered in its own session (see newSession),
+// so Respond is safe to call concurrently, also with Preprocess.
+type Server struct {
+	pp *PSIParams
+	N  int
 
-	sets     [][]uint64
 	raw_sets [][]uint64
+	labels   []Label // labels of raw_sets (see NewLabeledServer)
 	// set_ptx *bfv.Plaintext
 
-	// Does not support concurrency at the moment
+	// Number of goroutines used to evaluate a query, fixed at creation (see WithWorkers)
+	workers int
+
+	// Preprocessed collection (see Preprocess), written under the lock while no query runs
+	mu         sync.RWMutex
+	bitVecPtxs []*bfv.PlaintextMul // bit vectors of the batches of sdSetsPerCtx sets (raw order)
+	binPolys   [][][]uint64        // interpolated polynomial of every bin of every set
+}
+
+// The state of the server while answering one query, bound to the key of the client.
+type session struct {
+	*Server
+
+	// The server sets in the order of the response (shuffled for ca-ms and th-ms),
+	// and their index in raw_sets (nil for the raw order, -1 for an empty block)
+	sets  [][]uint64
+	order []int
+	// Number of packed client sets, 0 without packing (see packSets)
+	packed int
+
+	encoder   bfv.Encoder
 	encryptor bfv.Encryptor
 	evaluator bfv.Evaluator
+	rotations keyRotations // rotations by powers of 2 of the key
+	// per-worker evaluators (shallow copies of evaluator) and encoders
+	evaluators []bfv.Evaluator
+	encoders   []bfv.Encoder
 }
 
-func NewServer(pp *PSIParams, sets [][]uint64) (*server, error) {
-	params := pp.params
-	encoder := bfv.NewEncoder(params)
+// ServerOption configures a server at creation, see NewServer.
+type ServerOption func(*Server)
 
-	N := int(params.N())
+// WithWorkers sets the number of goroutines evaluating a query (default: the number of CPUs).
+func WithWorkers(workers int) ServerOption {
+	return func(sv *Server) {
+		sv.workers = workers
+	}
+}
+
+func NewServer(pp *PSIParams, sets [][]uint64, opts ...ServerOption) (*Server, error) {
+	if err := pp.checkServerBins(); err != nil {
+		return nil, err
+	}
+	N := int(pp.params.N())
 
-	return &server{
+	sv := &Server{
 		pp:       pp,
-		encoder:  encoder,
 		N:        N,
 		raw_sets: sets,
-		sets:     nil,
+		workers:  runtime.NumCPU(),
 		// set_ptx: nil,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(sv)
+	}
+	return sv, nil
 }
 
-func (sv *server) ShuffleSets() {
-	sv.sets = make([][]uint64, len(sv.raw_sets))
-	perm := rand.Perm(len(sv.raw_sets))
-	for i := range perm {
-		sv.sets[i] = sv.raw_sets[perm[i]]
+// Params returns the parameters of the server, which the queries are checked against (see PsiQuery.CheckQuery).
+func (sv *Server) Params() *PSIParams {
+	return sv.pp
+}
+
+func (sv *session) shuffleSets() {
+	sv.setOrder(randPerm(len(sv.raw_sets)))
+}
+
+func (sv *session) setOrder(order []int) {
+	sv.order = order
+	sv.sets = make([][]uint64, len(order))
+	for i := range order {
+		if order[i] >= 0 {
+			sv.sets[i] = sv.raw_sets[order[i]]
+		}
 	}
 }
 
-func (sv *server) prepareForQuery(key *clientKey) {
-	sv.encryptor = bfv.NewEncryptorFromPk(sv.pp.params, key.pk)
-	sv.evaluator = bfv.NewEvaluator(sv.pp.params, *key.evk)
+// Index in raw_sets of the n-th set
+func (sv *session) rawIndex(n int) int {
+	if sv.order == nil {
+		return n
+	}
+	return sv.order[n]
 }
 
-func (sv *server) Respond(query *psiQuery, key *clientKey) (*psiResponse, error) {
-	sv.prepareForQuery(key)
+func (sv *Server) newSession(key *ClientKey) *session {
+	params := sv.pp.params
+	s := &session{
+		Server:    sv,
+		sets:      sv.raw_sets,
+		encoder:   bfv.NewEncoder(params),
+		encryptor: bfv.NewEncryptorFromPk(params, key.pk),
+		evaluator: bfv.NewEvaluator(params, *key.evk),
+		rotations: newKeyRotations(sv.pp, key.evk),
+	}
 
-	var resp psiResponse
+	workers := sv.workers
+	if workers < 1 {
+		workers = 1
+	}
+	s.evaluators = make([]bfv.Evaluator, workers)
+	s.encoders = make([]bfv.Encoder, workers)
+	s.evaluators[0], s.encoders[0] = s.evaluator, s.encoder
+	for w := 1; w < workers; w++ {
+		s.evaluators[w] = s.evaluator.ShallowCopy()
+		s.encoders[w] = bfv.NewEncoder(params)
+	}
+	return s
+}
+
+// Runs f(evaluator, encoder, i) for i \in [0, n) on the server workers.
+// Each worker owns its evaluator and encoder, f must only write to the i-th output.
+// Returns the first error encountered, a panic of f included.
+func (sv *session) parallelFor(n int, f func(evaluator bfv.Evaluator, encoder bfv.Encoder, i int) error) error {
+	workers := len(sv.evaluators)
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := runGuarded(f, sv.evaluator, sv.encoder, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	jobs := make(chan int)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := range jobs {
+				if errs[w] == nil {
+					errs[w] = runGuarded(f, sv.evaluators[w], sv.encoders[w], i)
+				}
+			}
+		}(w)
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs f(evaluator, encoder, i) and returns its panic as an error: a malformed query must not
+// crash the server from a worker goroutine, where no caller can recover it.
+func runGuarded(f func(evaluator bfv.Evaluator, encoder bfv.Encoder, i int) error, evaluator bfv.Evaluator, encoder bfv.Encoder, i int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("evaluation of item %v failed: %v", i, r)
+		}
+	}()
+	return f(evaluator, encoder, i)
+}
+
+// Respond answers a query with the key of its client. It can be called from several goroutines at once.
+func (sv *Server) Respond(query *PsiQuery, key *ClientKey) (*PsiResponse, error) {
+	if err := checkRotationKeys(sv.pp, query.queryType, key.evk); err != nil {
+		return nil, err
+	}
+	if err := query.CheckQuery(sv.pp); err != nil {
+		return nil, err
+	}
+	if err := sv.checkThreshold(query.queryType); err != nil {
+		return nil, err
+	}
+	if query.queryType.WithLabels && sv.labels == nil {
+		return nil, errors.New("the server sets are not labeled")
+	}
+	sv.mu.RLock()
+	defer sv.mu.RUnlock()
+	return sv.newSession(key).respond(query)
+}
+
+func (sv *session) respond(query *PsiQuery) (*PsiResponse, error) {
+	var resp PsiResponse
 	qt := query.queryType
 	var ctxs []*bfv.Ciphertext
 
-	if qt.Aggregation == AGGREGATION_CA_MS {
-		sv.ShuffleSets()
-	} else {
-		sv.sets = sv.raw_sets
+	if qt.Aggregation == AGGREGATION_CA_MS || qt.Aggregation == AGGREGATION_TH_MS {
+		sv.shuffleSets()
+	}
+	if queryNum := qt.queryNum(); queryNum > 1 {
+		// Every server set meets each packed client set in its own block
+		sv.packSets(queryNum)
 	}
 
 	// Single-set layer
@@ -79,17 +234,33 @@ func (sv *server) Respond(query *psiQuery, key *clientKey) (*psiResponse, error)
 				ctxs = BatchSIMDctxs(sv.pp, sv.evaluator, ctxs, sv.pp.SdBitVecLen)
 				Logger.Debug().Msgf("Number of batched cardinality ciphertexts: %v", len(ctxs))
 			}
+		} else if qt.Psi == PSI_PSI {
+			Logger.Info().Msgf("server: computing psi")
+			var err error
+			if ctxs, err = sv.computePSI_SD(query); err != nil {
+				return nil, err
+			}
 		}
 	} else if !qt.IsSmallDomain {
 		Logger.Info().Msgf("server: running large domain psi")
-		var err error
-		ctxs, err = sv.interpolationPSI(query)
-		if err != nil {
-			return nil, err
+		if qt.Psi == PSI_CA && qt.Matching != MATCHING_NONE {
+			return nil, errors.New("large domain epsi-ca does not support matching")
 		}
+		// The responses to the query ciphertexts follow each other
+		for j, queryCtx := range query.ctxs {
+			chunkCtxs, err := sv.interpolationPSI(queryCtx)
+			if err != nil {
+				return nil, err
+			}
 
-		if qt.Psi == PSI_CA {
-			return nil, errors.New("currently epsi-ca is not supported in the large domain")
+			if qt.Psi == PSI_CA {
+				Logger.Info().Msgf("server: shuffling intersection indicators for psi-ca")
+				chunkSize := query.clientSetSize - j*sv.pp.MaxClientElemPerCtx
+				if err := sv.shuffleIntersectionIndicators(chunkSize, chunkCtxs); err != nil {
+					return nil, err
+				}
+			}
+			ctxs = append(ctxs, chunkCtxs...)
 		}
 	}
 
@@ -97,12 +268,18 @@ func (sv *server) Respond(query *psiQuery, key *clientKey) (*psiResponse, error)
 	if qt.Matching == MATCHING_FPSM {
 		Logger.Info().Msgf("server: running f-psm")
 
-		sv.evalFPSM(ctxs)
+		if err := sv.evalFPSM(ctxs); err != nil {
+			return nil, err
+		}
+		ctxs = sv.mergeQueryChunks(ctxs, len(query.ctxs))
 		ctxs = sv.batchPSMresps(ctxs)
 	} else if qt.Matching == MATCHING_TVERSKY || qt.Matching == MATCHING_TVERSKY_PLAIN {
 		Logger.Info().Msgf("server: running tversky.")
 		// compute plain tversky score
-		tvCtx := sv.computeTversky(query, ctxs)
+		tvCtx, err := sv.computeTversky(query, ctxs)
+		if err != nil {
+			return nil, err
+		}
 		Logger.Debug().Msgf("Number of Tv ciphertexts: %v", len(ctxs))
 		// batch scores into the minimal number of ctxs
 		ctxs = BatchSIMDctxs(sv.pp, sv.evaluator, tvCtx, sv.pp.SdBitVecLen)
@@ -111,40 +288,93 @@ func (sv *server) Respond(query *psiQuery, key *clientKey) (*psiResponse, error)
 		// Convert plain score into binary matching result
 		if qt.Matching != MATCHING_TVERSKY_PLAIN {
 			Logger.Info().Msgf("server: convert tversky scores to binary matching.")
-			sv.convertTverskyScoreToBinary(ctxs, MAX_TVERSKY_SCORE)
+			scoreLim, _ := qt.Tversky.ScoreLimit()
+			if err := sv.convertTverskyScoreToBinary(ctxs, scoreLim); err != nil {
+				return nil, err
+			}
+		}
+	} else if isSmallDomainFPSM(qt.Matching) {
+		Logger.Info().Msgf("server: running small domain f-psm")
+		a, b, c := sdFPSMCoefficients(qt.Matching)
+		scoreCtx, err := sv.computeLinearScore(query, ctxs, a, b, c)
+		if err != nil {
+			return nil, err
+		}
+		ctxs = BatchSIMDctxs(sv.pp, sv.evaluator, scoreCtx, sv.pp.SdBitVecLen)
+		if err := sv.randomizeBatchedResults(qt, ctxs); err != nil {
+			return nil, err
+		}
+	} else if isSimilarityMetric(qt.Matching) {
+		Logger.Info().Msgf("server: running similarity matching.")
+		var err error
+		if ctxs, err = sv.computeSimilarity(query, ctxs); err != nil {
+			return nil, err
+		}
+		if err := sv.randomizeBatchedResults(qt, ctxs); err != nil {
+			return nil, err
+		}
+	} else if qt.Matching == MATCHING_HAMMING {
+		Logger.Info().Msgf("server: running hamming matching with radius %v", qt.HammingRadius)
+		var err error
+		if ctxs, err = sv.computeHamming(query, ctxs); err != nil {
+			return nil, err
+		}
+		if err := sv.randomizeBatchedResults(qt, ctxs); err != nil {
+			return nil, err
 		}
 	}
 
 	// Many-set layer
 	if qt.Aggregation == AGGREGATION_X_MS {
 		Logger.Info().Msgf("server: running x-ms aggregation")
-		if qt.Matching == MATCHING_FPSM {
-			sv.aggregateFPSM(ctxs)
+		if qt.Matching == MATCHING_FPSM || isBatchedSDMatching(qt.Matching) {
+			var err error
+			if ctxs, err = sv.aggregateFPSM(qt, ctxs); err != nil {
+				return nil, err
+			}
 		} else if qt.Matching == MATCHING_TVERSKY {
 			ctxs = sv.aggregateTversky(ctxs)
 		}
 	} else if qt.Aggregation == AGGREGATION_CA_MS {
 		Logger.Info().Msgf("server: running ca-ms aggregation")
+	} else if qt.Aggregation == AGGREGATION_TH_MS {
+		Logger.Info().Msgf("server: running th-ms aggregation with threshold %v", qt.Threshold)
+		var err error
+		if ctxs, err = sv.aggregateThreshold(qt, ctxs); err != nil {
+			return nil, err
+		}
 	}
 
 	// add malicious check
 	if qt.IsSmallDomain {
-		malCheck := SDMaliciousCheck(sv.pp, sv.evaluator, query.ctx)
+		malCheck := sdMaliciousCheck(sv.pp, sv.evaluator, query.ctxs[0], qt.queryNum(), sv.rotations)
 		for i := 0; i < len(ctxs); i++ {
 			check := RandomizeMltCtx(sv.pp, sv.evaluator, malCheck)
 			ctxs[i] = sv.evaluator.AddNew(ctxs[i], check)
 		}
 	} else {
-		malCheck := PolynomialMaliciousCheck(sv.pp, sv.evaluator, query.ctx)
+		malCheck := polynomialMaliciousCheck(sv.pp, sv.evaluator, query.ctxs[0], sv.rotations)
+		for _, queryCtx := range query.ctxs[1:] {
+			sv.evaluator.Add(malCheck, polynomialMaliciousCheck(sv.pp, sv.evaluator, queryCtx, sv.rotations), malCheck)
+		}
 		for i := range ctxs {
 			sv.evaluator.Add(ctxs[i], malCheck, ctxs[i])
 		}
 	}
 
-	resp = psiResponse{
-		serverSetNum: len(sv.sets),
+	resp = PsiResponse{
+		serverSetNum: len(sv.raw_sets),
 		ctxs:         ctxs,
 	}
+
+	// The label keys are derived from the checked results
+	if qt.WithLabels {
+		Logger.Info().Msgf("server: sealing labels")
+		var err error
+		if resp.labelCtxs, resp.labels, err = sv.sealLabels(qt, ctxs); err != nil {
+			return nil, err
+		}
+	}
 	return &resp, nil
 }
 
@@ -152,79 +382,65 @@ func (sv *server) Respond(query *psiQuery, key *clientKey) (*psiResponse, error)
 //     Single-set protocols     //
 //////////////////////////////////
 
-func (sv *server) computePSI_CA_SD(query *psiQuery) ([]*bfv.Ciphertext, error) {
-	// totalCipherNum: Number of input ciphertexts
-	totalCipherNum := (len(sv.sets) + sv.pp.sdSetsPerCtx - 1) / sv.pp.sdSetsPerCtx
-	caCtx := make([]*bfv.Ciphertext, 0, totalCipherNum)
+func (sv *session) computePSI_CA_SD(query *PsiQuery) ([]*bfv.Ciphertext, error) {
+	// cipherNum: Number of input ciphertexts
+	cipherNum := FitLen(len(sv.sets), sv.pp.sdSetsPerCtx)
+	caCtx := make([]*bfv.Ciphertext, cipherNum)
 
-	// shard: number of (repacked) output ciphertexts
-	for shard := 0; shard*sv.N < len(sv.sets); shard++ {
+	var bar *progressbar.ProgressBar
+	if ENABLE_PROGRESS_BAR {
+		bar = progressbar.Default(int64(len(sv.sets)), "Intersection progress")
+	}
 
-		// select shard's server sets.
-		end := (shard + 1) * int(sv.pp.params.N())
-		if end > len(sv.sets) {
-			end = len(sv.sets)
+	err := sv.parallelFor(cipherNum, func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
+		next := (k + 1) * sv.pp.sdSetsPerCtx
+		if next > len(sv.sets) {
+			next = len(sv.sets)
 		}
-
-		sets := sv.sets[shard*sv.N : end]
-		cipherNum := (len(sets) + sv.pp.sdSetsPerCtx - 1) / sv.pp.sdSetsPerCtx
-		var bar *progressbar.ProgressBar
-		if ENABLE_PROGRESS_BAR {
-			bar = progressbar.Default(int64(len(sets)), "Intersection progress")
+		selectPtx, err := sv.bitVectorPtx(encoder, k)
+		if err != nil {
+			return err
 		}
+		selCtx := evaluator.MulNew(query.ctxs[0], selectPtx)
+		SumSIMD(evaluator, selCtx, sv.pp.SdBitVecLen)
 
-		for k := 0; k < cipherNum; k++ {
-			bitVec := make([]uint64, sv.pp.params.N())
-			next := (k + 1) * sv.pp.sdSetsPerCtx
-			if next > len(sets) {
-				next = len(sets)
-			}
-			err := EncodeSetsAsBitVector(sets[k*sv.pp.sdSetsPerCtx:next], sv.pp.SdBitVecLen, bitVec)
-			if err != nil {
-				return nil, err
-			}
-
-			selectPtx := bfv.NewPlaintextMul(sv.pp.params)
-			sv.encoder.EncodeUintMul(bitVec, selectPtx)
-			selCtx := sv.evaluator.MulNew(query.ctx, selectPtx)
-			SumSIMD(sv.evaluator, selCtx, sv.pp.SdBitVecLen)
-
-			// IMPORTANT not secure for simple cardinality -> improves noise for tversky
-			// caCtx[k] = FilterSIMD(sv.evaluator, selCtx, sv.pp.sdBitVecLen)
-			caCtx = append(caCtx, selCtx)
+		// IMPORTANT not secure for simple cardinality -> improves noise for tversky
+		// caCtx[k] = FilterSIMD(sv.evaluator, selCtx, sv.pp.sdBitVecLen)
+		caCtx[k] = selCtx
 
-			if ENABLE_PROGRESS_BAR {
-				bar.Set(next)
-			}
+		if ENABLE_PROGRESS_BAR {
+			bar.Add(next - k*sv.pp.sdSetsPerCtx)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return caCtx, nil
 }
 
-func (sv *server) interpolationPSI(query *psiQuery) ([]*bfv.Ciphertext, error) {
-	ctxs := make([]*bfv.Ciphertext, FitLen(len(sv.sets), sv.pp.ClRepNum))
+func (sv *session) interpolationPSI(queryCtx *bfv.Ciphertext) ([]*bfv.Ciphertext, error) {
+	ctxs := make([]*bfv.Ciphertext, FitLen(len(sv.sets), sv.pp.ldSetsPerCtx))
 	rowN := int(sv.pp.params.N()) / 2
 
-	ptx := bfv.NewPlaintextMul(sv.pp.params)
-
-	for cn := 0; cn < len(ctxs); cn++ {
+	err := sv.parallelFor(len(ctxs), func(evaluator bfv.Evaluator, encoder bfv.Encoder, cn int) error {
 		expandedSet := make([]uint64, sv.pp.params.N())
 
+		var polys [][]uint64
 		for rep := 0; rep < sv.pp.ClRepNum; rep++ {
-			n := cn*sv.pp.ClRepNum + rep
+			// Each server set takes ServerBins consecutive replicas, one per bin
+			n := cn*sv.pp.ldSetsPerCtx + rep/sv.pp.ServerBins
 			if n >= len(sv.sets) {
 				continue
 			}
-			if len(sv.sets[n]) > sv.pp.ClientPolyExpansion-1 {
-				return nil, errors.New("too many elements in one of server sets")
+			if rep%sv.pp.ServerBins == 0 {
+				var err error
+				if polys, err = sv.setPolys(n); err != nil {
+					return err
+				}
 			}
-
-			// Note:
-			// Interpolation works as: a[0]*1 + a[1]*x + a[2]*x^2 ...
-			// Client packs input as: c, c^2, c^3, ...
-			// The starting difference 1 vs c acts as adding (x == 0) to roots
-			a := InterpolateFromRoots(sv.pp, sv.sets[n])
+			a := polys[rep%sv.pp.ServerBins]
 			// randomize a for each use
 
 			for k := 0; k < sv.pp.MaxClientElemPerCtx/2; k++ {
@@ -238,48 +454,137 @@ func (sv *server) interpolationPSI(query *psiQuery) ([]*bfv.Ciphertext, error) {
 			}
 		}
 
-		sv.encoder.EncodeUintMul(expandedSet, ptx)
-		ctxs[cn] = sv.evaluator.MulNew(query.ctx, ptx)
-		SumSIMD(sv.evaluator, ctxs[cn], sv.pp.ClientPolyExpansion)
+		ptx := bfv.NewPlaintextMul(sv.pp.params)
+		encoder.EncodeUintMul(expandedSet, ptx)
+		ctxs[cn] = evaluator.MulNew(queryCtx, ptx)
+		SumSIMD(evaluator, ctxs[cn], sv.pp.ClientPolyExpansion)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return ctxs, nil
 }
 
+// Converts the output of interpolationPSI into a cardinality response.
+// The indicators of the client elements are shuffled within each server set (across all its bins),
+// so the client only learns how many of its elements are in the set (number of zero indicators), not which ones.
+// Without bins, indicators of the empty query positions (from clientSetSize on) are replaced by random non-zero values.
+// With bins, the server does not know the empty positions and the client discounts them.
+func (sv *session) shuffleIntersectionIndicators(clientSetSize int, ctxs []*bfv.Ciphertext) error {
+	m := sv.pp.MaxClientElemPerCtx * sv.pp.ServerBins
+	half := sv.pp.MaxClientElemPerCtx / 2
+	params := sv.pp.params
+
+	// Row and column (in units of ClientPolyExpansion) of the p-th indicator of a server set
+	position := func(set, p int) (row, col int) {
+		rep, k := set*sv.pp.ServerBins+p/sv.pp.MaxClientElemPerCtx, p%sv.pp.MaxClientElemPerCtx
+		return k / half, rep*half + k%half
+	}
+
+	return sv.parallelFor(len(ctxs), func(evaluator bfv.Evaluator, encoder bfv.Encoder, cn int) error {
+		// masks[rowSwap][colShift + m/2 - 1] selects the slots moved by the same rotation
+		masks := [2][][]uint64{make([][]uint64, m-1), make([][]uint64, m-1)}
+		padding := make([]uint64, params.N())
+
+		for set := 0; set < sv.pp.ldSetsPerCtx; set++ {
+			if cn*sv.pp.ldSetsPerCtx+set >= len(sv.sets) {
+				continue
+			}
+			perm := randPerm(m)
+			for p := 0; p < m; p++ {
+				src := largeDomainSlot(sv.pp, set*sv.pp.ServerBins+p/sv.pp.MaxClientElemPerCtx, p%sv.pp.MaxClientElemPerCtx)
+				if sv.pp.ServerBins == 1 && p >= clientSetSize {
+					padding[src] = randNonZero(params.T())
+				}
+
+				srcRow, srcCol := position(set, p)
+				dstRow, dstCol := position(set, perm[p])
+				swap := 0
+				if srcRow != dstRow {
+					swap = 1
+				}
+				shift := srcCol - dstCol
+				if masks[swap][shift+m/2-1] == nil {
+					masks[swap][shift+m/2-1] = make([]uint64, params.N())
+				}
+				masks[swap][shift+m/2-1][src] = 1
+			}
+		}
+
+		paddingPtx := bfv.NewPlaintext(params)
+		encoder.EncodeUint(padding, paddingPtx)
+		evaluator.Add(ctxs[cn], paddingPtx, ctxs[cn])
+
+		terms := make([]*bfv.Ciphertext, 0, 2*(m-1))
+		for swap := 0; swap < 2; swap++ {
+			for i, mask := range masks[swap] {
+				if mask == nil {
+					continue
+				}
+				maskPtx := bfv.NewPlaintextMul(params)
+				encoder.EncodeUintMul(mask, maskPtx)
+				term := evaluator.MulNew(ctxs[cn], maskPtx)
+				if swap == 1 {
+					evaluator.RotateRows(term, term)
+				}
+				terms = append(terms, ExtendedRotate(sv.pp, evaluator, term, (i-m/2+1)*sv.pp.ClientPolyExpansion))
+			}
+		}
+		ctxs[cn] = ArrayOperation(evaluator, terms, false)
+		return nil
+	})
+}
+
 //////////////////////////////////
 //        PSM protocols         //
 //////////////////////////////////
 
-func (sv *server) evalFPSM(psi []*bfv.Ciphertext) {
+func (sv *session) evalFPSM(psi []*bfv.Ciphertext) error {
 	params := sv.pp.params
 	rowN := int(params.N()) / 2
 
-	raw := make([]uint64, params.N())
-	ptx := bfv.NewPlaintextMul(params)
-	batchSize := rowN / sv.pp.ClRepNum
+	// The replicas of all the bins of a server set are summed together
+	batchSize := rowN / sv.pp.ldSetsPerCtx
 
-	for k := 0; k < len(psi); k++ {
+	return sv.parallelFor(len(psi), func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
 		if k%10 == 0 {
 			Logger.Debug().Msgf("Running FPSM %v.", k)
 		}
-		psi[k] = SIMDOperation(sv.evaluator, psi[k],
+		psi[k] = SIMDOperation(evaluator, psi[k],
 			sv.pp.ClientPolyExpansion,
-			rowN/sv.pp.ClRepNum,
+			batchSize,
 			true, false)
 
 		// Randomizes non-zero c[0] and zero out everything else
 		// Assumes one set per ctx
-		for i := 0; i < sv.pp.ClRepNum; i++ {
-			raw[i*batchSize] = (rand.Uint64() % (params.T() - 1)) + 1
+		raw := make([]uint64, params.N())
+		for i := 0; i < sv.pp.ldSetsPerCtx; i++ {
+			raw[i*batchSize] = randNonZero(params.T())
 		}
-		sv.encoder.EncodeUintMul(raw, ptx)
+		ptx := bfv.NewPlaintextMul(params)
+		encoder.EncodeUintMul(raw, ptx)
+
+		evaluator.Mul(psi[k], ptx, psi[k])
+		evaluator.Relinearize(psi[k], psi[k])
+		return nil
+	})
+}
 
-		sv.evaluator.Mul(psi[k], ptx, psi[k])
-		sv.evaluator.Relinearize(psi[k], psi[k])
+// Combines the f-psm results of the query ciphertexts: a server set matches if the results
+// for all the query ciphertexts are zero. evalFPSM randomizes each result independently.
+func (sv *session) mergeQueryChunks(psm []*bfv.Ciphertext, queryCtxNum int) []*bfv.Ciphertext {
+	perQuery := len(psm) / queryCtxNum
+	for j := 1; j < queryCtxNum; j++ {
+		for i := 0; i < perQuery; i++ {
+			sv.evaluator.Add(psm[i], psm[j*perQuery+i], psm[i])
+		}
 	}
+	return psm[:perQuery]
 }
 
-func (sv *server) batchPSMresps(psm []*bfv.Ciphertext) (ctxs []*bfv.Ciphertext) {
-	batchSize := sv.N / 2 / sv.pp.ClRepNum
+func (sv *session) batchPSMresps(psm []*bfv.Ciphertext) (ctxs []*bfv.Ciphertext) {
+	batchSize := sv.N / 2 / sv.pp.ldSetsPerCtx
 
 	ctxs = make([]*bfv.Ciphertext, FitLen(len(psm), 2*batchSize))
 
@@ -301,7 +606,8 @@ func (sv *server) batchPSMresps(psm []*bfv.Ciphertext) (ctxs []*bfv.Ciphertext)
 
 	// Set the value of empty sets to 1.
 	// Note that empty sets are guaranteed to have PSM output equal to zero.
-	mask := createFPSImask(len(sv.sets)%sv.N, sv.pp)
+	// Each batched ciphertext holds N sets, the last one holds the remaining sets.
+	mask := createFPSImask(len(sv.sets)-(len(ctxs)-1)*sv.N, sv.pp)
 	maskPtx := bfv.NewPlaintext(sv.pp.params)
 	sv.encoder.EncodeUint(mask, maskPtx)
 	sv.evaluator.Add(ctxs[len(ctxs)-1], maskPtx, ctxs[len(ctxs)-1])
@@ -309,19 +615,23 @@ func (sv *server) batchPSMresps(psm []*bfv.Ciphertext) (ctxs []*bfv.Ciphertext)
 	return ctxs
 }
 
-func (sv *server) computeTversky(query *psiQuery, intersectionCaCtx []*bfv.Ciphertext) []*bfv.Ciphertext {
-	// Tversky params for \alpha = \beta = 1, t = 80%
-	var a, b, c uint64 = 9, 4, 4
+func (sv *session) computeTversky(query *PsiQuery, intersectionCaCtx []*bfv.Ciphertext) ([]*bfv.Ciphertext, error) {
+	a, b, c, _ := query.queryType.Tversky.Coefficients()
+	return sv.computeLinearScore(query, intersectionCaCtx, a, b, c)
+}
 
+// Computes a|X∩S| - b|X| - c|S| for every server set S from the output of computePSI_CA_SD
+func (sv *session) computeLinearScore(query *PsiQuery, intersectionCaCtx []*bfv.Ciphertext, a, b, c uint64) ([]*bfv.Ciphertext, error) {
 	tvCtx := make([]*bfv.Ciphertext, len(intersectionCaCtx))
 
 	// compute the cardinality of the client's set |X|. (Different from intersection cardinality)
-	clientCaCtx := query.ctx.CopyNew().Ciphertext()
+	clientCaCtx := query.ctxs[0].CopyNew().Ciphertext()
 	SumSIMD(sv.evaluator, clientCaCtx, sv.pp.SdBitVecLen)
 	sv.evaluator.MulScalar(clientCaCtx, b, clientCaCtx)
 
-	for k := 0; k < len(intersectionCaCtx); k++ {
-		sv.evaluator.MulScalar(intersectionCaCtx[k], a, intersectionCaCtx[k])
+	err := sv.parallelFor(len(intersectionCaCtx), func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
+		// the intersections are not modified, overlap evaluates two scores
+		intersection := evaluator.MulScalarNew(intersectionCaCtx[k], a)
 
 		// set server sets' cardinality |S_i|
 		serverCaRaw := make([]uint64, sv.pp.params.N())
@@ -331,44 +641,81 @@ func (sv *server) computeTversky(query *psiQuery, intersectionCaCtx []*bfv.Ciphe
 			}
 		}
 		serverCaPtx := bfv.NewPlaintext(sv.pp.params)
-		sv.encoder.EncodeUint(serverCaRaw, serverCaPtx)
-
-		tmp := sv.evaluator.AddNew(serverCaPtx, clientCaCtx)
-		tvCtx[k] = sv.evaluator.SubNew(intersectionCaCtx[k], tmp)
+		encoder.EncodeUint(serverCaRaw, serverCaPtx)
+
+		tmp := evaluator.AddNew(serverCaPtx, clientCaCtx)
+		tvCtx[k] = evaluator.SubNew(intersection, tmp)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return tvCtx
+	return tvCtx, nil
 }
 
-func (sv *server) convertTverskyScoreToBinary(tvCtx []*bfv.Ciphertext, scoreLim int) {
-	for i := 0; i < len(tvCtx); i++ {
+func (sv *session) convertTverskyScoreToBinary(tvCtx []*bfv.Ciphertext, scoreLim int) error {
+	return sv.parallelFor(len(tvCtx), func(evaluator bfv.Evaluator, encoder bfv.Encoder, i int) error {
 		// IMPORTANT range support varies with noise bidget
-		tvCtx[i] = IsInRange(sv.pp, sv.evaluator, tvCtx[i], scoreLim)
+		tvCtx[i] = IsInRange(sv.pp, evaluator, tvCtx[i], scoreLim)
 
 		// randomizing Tversky out to ensure privacy
 		rPtx := GenRandomPtx(sv.pp.params, false)
-		sv.evaluator.Mul(tvCtx[i], rPtx, tvCtx[i])
-	}
+		evaluator.Mul(tvCtx[i], rPtx, tvCtx[i])
+		return nil
+	})
+}
+
+// Randomizes the batched small domain results of the server sets (zero iff the set matches),
+// and sets the slots without a set to 1 (a non-matching value).
+func (sv *session) randomizeBatchedResults(qt QueryType, ctxs []*bfv.Ciphertext) error {
+	params := sv.pp.params
+	layout := newBatchLayout(sv.pp, qt, len(sv.sets))
+
+	return sv.parallelFor(len(ctxs), func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
+		raw := make([]uint64, sv.N)
+		pad := make([]uint64, sv.N)
+		for i := range pad {
+			pad[i] = 1
+		}
+		for n := 0; n < sv.N && k*sv.N+n < len(sv.sets); n++ {
+			raw[layout.slots[n]], pad[layout.slots[n]] = randNonZero(params.T()), 0
+		}
+		rPtx := bfv.NewPlaintextMul(params)
+		encoder.EncodeUintMul(raw, rPtx)
+		padPtx := bfv.NewPlaintext(params)
+		encoder.EncodeUint(pad, padPtx)
+
+		evaluator.Mul(ctxs[k], rPtx, ctxs[k])
+		evaluator.Add(ctxs[k], padPtx, ctxs[k])
+		return nil
+	})
 }
 
 //////////////////////////////////
 //     Many-set aggregation     //
 //////////////////////////////////
 
-func (sv *server) aggregateFPSM(ctxs []*bfv.Ciphertext) error {
-	// ONLY SUPPORTS 1 CTX
-	if len(ctxs)*sv.pp.ClRepNum > sv.N {
-		return errors.New("too many server sets")
+// Multiplies the f-psm results of all the server sets into slot 0 of a single ciphertext.
+// The batched ciphertexts are multiplied first (the slots without a set hold 1, see batchPSMresps
+// and randomizeBatchedResults), then the slots of their product, so the depth is logarithmic in the number of server sets.
+func (sv *session) aggregateFPSM(qt QueryType, ctxs []*bfv.Ciphertext) ([]*bfv.Ciphertext, error) {
+	// The small domain matching layer, the randomization of the f-psm layer, and the product tree
+	layout := newBatchLayout(sv.pp, qt, len(sv.sets))
+	depth := 1 + layout.depth(len(ctxs)) + batchedMatchingDepth(qt)
+	if maxDepth := sv.pp.MaxDepth(); maxDepth >= 0 && depth > maxDepth {
+		return nil, fmt.Errorf("x-ms aggregation of %v server sets requires depth %v but the parameters only support %v",
+			len(sv.sets), depth, maxDepth)
 	}
 
-	batchSize := sv.N / 2 / sv.pp.ClRepNum
-	rotateToPositive := len(ctxs) - 1
-	ctxs[0] = ExtendedRotate(sv.pp, sv.evaluator, ctxs[0], -rotateToPositive)
-	ctxs[0] = SIMDOperation(sv.evaluator, ctxs[0], 1, len(ctxs), false, true)
-	ctxs[0] = SIMDOperation(sv.evaluator, ctxs[0], batchSize, sv.N/2, false, true)
-	return nil
+	stride := batchStride(sv.pp, qt)
+	ctx := ArrayOperation(sv.evaluator, ctxs, true)
+	ctx = ExtendedRotate(sv.pp, sv.evaluator, ctx, -(layout.m - 1))
+	ctx = SIMDOperation(sv.evaluator, ctx, 1, layout.m, false, true)
+	ctx = SIMDOperation(sv.evaluator, ctx, stride, layout.strides*stride, layout.rows, true)
+	return []*bfv.Ciphertext{ctx}, nil
 }
 
-func (sv *server) aggregateTversky(ctxs []*bfv.Ciphertext) []*bfv.Ciphertext {
+func (sv *session) aggregateTversky(ctxs []*bfv.Ciphertext) []*bfv.Ciphertext {
 	maxMultDept := 64
 	if len(ctxs) == 1 {
 		// internal aggregation when only one response ctx exists
@@ -395,38 +742,48 @@ func (sv *server) aggregateTversky(ctxs []*bfv.Ciphertext) []*bfv.Ciphertext {
 //
 // //////////////////////////
 func PolynomialMaliciousCheck(pp *PSIParams, evaluator bfv.Evaluator, poly *bfv.Ciphertext) *bfv.Ciphertext {
+	return polynomialMaliciousCheck(pp, evaluator, poly, nil)
+}
+
+// The check is summed over all the slots with the rotations of the key (see sumAllSlots)
+func polynomialMaliciousCheck(pp *PSIParams, evaluator bfv.Evaluator, poly *bfv.Ciphertext, rots keyRotations) *bfv.Ciphertext {
 	// Computes P.rShifted == [P.rRaw.(cc-cn)].rot(-1)
+	// in the frame where each block of P ends at its c[0] slot (P rotated by ClientPolyExpansion-1),
+	// so that only rotations by less than ClientPolyExpansion are needed.
+	n := pp.ClientPolyExpansion
+	rowN := int(pp.params.N()) / 2
 
 	encoder := bfv.NewEncoder(pp.params)
 
 	rVec := GenRandomVector(pp.params.N(), pp.params.T(), false)
 	rRawPtx := bfv.NewPlaintext(pp.params)
 	encoder.EncodeUint(rVec, rRawPtx)
-	for i := pp.params.N() - 1; i > 0; i-- {
-		rVec[i] = rVec[i-1]
-	}
-	for i := 0; i < int(pp.params.N()); i += pp.ClientPolyExpansion {
-		rVec[i] = 0
+	// The slot before the first slot of a block belongs to the previous block
+	rShifted := make([]uint64, len(rVec))
+	for i := range rShifted {
+		if i%n != 1%n {
+			rShifted[i] = rVec[i-i%rowN+(i+rowN-1)%rowN]
+		}
 	}
 	rShiftedPtx := bfv.NewPlaintext(pp.params)
-	encoder.EncodeUint(rVec, rShiftedPtx)
+	encoder.EncodeUint(rShifted, rShiftedPtx)
 
-	c0 := FilterSIMD(pp, evaluator, poly, pp.ClientPolyExpansion)     //c in c[0]
-	cn := ExtendedRotate(pp, evaluator, c0, 1-pp.ClientPolyExpansion) //c in c[-1]
-	cc := SIMDOperation(evaluator, c0, 1, pp.ClientPolyExpansion, false, false)
-	cc = ExtendedRotate(pp, evaluator, cc, 1-pp.ClientPolyExpansion) // c in c[:]
-	ccMinCn := evaluator.SubNew(cc, cn)                              // c in c[:-1]
+	shifted := ExtendedRotate(pp, evaluator, poly, n-1)
+	cn := FilterSIMD(pp, evaluator, poly, n)               // c in c[-1]
+	cc := SIMDOperation(evaluator, cn, 1, n, false, false) // c in c[:]
+	ccMinCn := evaluator.SubNew(cc, cn)                    // c in c[:-1]
 
-	left := evaluator.MulNew(poly, rShiftedPtx)
-	right := evaluator.MulNew(poly, rRawPtx)
+	left := evaluator.MulNew(shifted, rShiftedPtx)
+	right := evaluator.MulNew(shifted, rRawPtx)
 	right = evaluator.MulNew(right, ccMinCn)
 	evaluator.Relinearize(right, right)
 	evaluator.RotateColumns(right, -1, right)
 	powerCheck := evaluator.SubNew(left, right)
 	malCheck := powerCheck
 
-	if pp.ClRepNum > 1 {
-		polyRepRot := evaluator.RotateColumnsNew(poly, int(pp.params.N())/2/pp.ClRepNum)
+	// Replicas of the same bin must be equal
+	if pp.ldSetsPerCtx > 1 {
+		polyRepRot := evaluator.RotateColumnsNew(poly, int(pp.params.N())/2/pp.ldSetsPerCtx)
 		duplicateCheck := evaluator.SubNew(poly, polyRepRot)
 		dupR := GenRandomPtx(pp.params, false)
 		duplicateCheck = evaluator.MulNew(duplicateCheck, dupR)
@@ -435,7 +792,7 @@ func PolynomialMaliciousCheck(pp *PSIParams, evaluator bfv.Evaluator, poly *bfv.
 		malCheck = evaluator.AddNew(powerCheck, duplicateCheck)
 	}
 
-	malCheck = SIMDOperation(evaluator, malCheck, 1, int(pp.params.N()/2), true, false)
+	malCheck = sumAllSlots(pp, evaluator, malCheck, rots)
 	finalR := GenRandomPtx(pp.params, false)
 	evaluator.Mul(malCheck, finalR, malCheck)
 	evaluator.Relinearize(malCheck, malCheck)
@@ -445,16 +802,50 @@ func PolynomialMaliciousCheck(pp *PSIParams, evaluator bfv.Evaluator, poly *bfv.
 
 // MalCheck MUST get re-randomized before use
 func SDMaliciousCheck(pp *PSIParams, evaluator bfv.Evaluator, q *bfv.Ciphertext) *bfv.Ciphertext {
+	return sdMaliciousCheck(pp, evaluator, q, 1, nil)
+}
+
+// The bit vectors of a query with queryNum packed sets repeat every queryNum blocks
+func sdMaliciousCheck(pp *PSIParams, evaluator bfv.Evaluator, q *bfv.Ciphertext, queryNum int, rots keyRotations) *bfv.Ciphertext {
 	qMinOne := evaluator.SubNew(q, pp.rangePtxs[1])
 	sdCheck := evaluator.MulNew(q, qMinOne)
 	evaluator.Relinearize(sdCheck, sdCheck)
 	sdCheck = RandomizeMltCtx(pp, evaluator, sdCheck)
 
-	qRepRot := evaluator.RotateColumnsNew(q, pp.SdBitVecLen)
+	qRepRot := evaluator.RotateColumnsNew(q, queryNum*pp.SdBitVecLen)
 	duplicateCheck := evaluator.SubNew(q, qRepRot)
 	duplicateCheck = RandomizeMltCtx(pp, evaluator, duplicateCheck)
 
 	malCheck := evaluator.AddNew(sdCheck, duplicateCheck)
-	malCheck = SIMDOperation(evaluator, malCheck, 1, int(pp.params.N()/2), true, false)
+	malCheck = sumAllSlots(pp, evaluator, malCheck, rots)
 	return malCheck
 }
+
+// CheckQuery verifies that a query was built for the parameters: the parameters support its
+// type, and it has the expected number of ciphertexts (one in the small domain, one per
+// MaxClientElemPerCtx elements in the large domain), each of degree 1 with polynomials of the
+// ring degree of the parameters reduced modulo their ciphertext moduli.
+func (query *PsiQuery) CheckQuery(pp *PSIParams) error {
+	if err := checkQuery(pp, query.queryType); err != nil {
+		return err
+	}
+	if query.clientSetSize < 0 {
+		return errors.New("query: negative client set size")
+	}
+	expected := 1
+	if !query.queryType.IsSmallDomain {
+		expected = pp.queryCtxNum(query.clientSetSize)
+	}
+	if len(query.ctxs) != expected {
+		return fmt.Errorf("query has %v ciphertexts, expected %v", len(query.ctxs), expected)
+	}
+	for i, ctx := range query.ctxs {
+		if ctx == nil || len(ctx.Value()) != 2 {
+			return fmt.Errorf("query ciphertext %v: not of degree 1", i)
+		}
+		if err := checkPolys(pp.params, pp.params.Qi(), ctx.Value()...); err != nil {
+			return fmt.Errorf("query ciphertext %v: %v", i, err)
+		}
+	}
+	return nil
+}
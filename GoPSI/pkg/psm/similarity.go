@@ -0,0 +1,297 @@
+package psm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Similarity metrics besides tversky. A server set S matches the client set X if sim(X, S) >= t,
+// where t and the bound on |X∩S| are the Threshold and MaxCardinality of QueryType.Similarity:
+//   - MATCHING_JACCARD: |X∩S| / |X∪S| (Tanimoto), i.e., tversky with alpha = beta = 1
+//   - MATCHING_DICE:    2|X∩S| / (|X| + |S|), i.e., tversky with alpha = beta = 1/2
+//   - MATCHING_COSINE:  |X∩S| / sqrt(|X||S|)
+//   - MATCHING_OVERLAP: |X∩S| / min(|X|, |S|)
+//
+// With t = p/q, the server evaluates integer inequalities over the cardinalities. Jaccard and dice
+// are linear (see TverskyParams.Coefficients), cosine is q²|X∩S|² - p²|X||S| >= 0, and overlap
+// holds if q|X∩S| - p|X| >= 0 or q|X∩S| - p|S| >= 0. Like tversky, the scores are checked with IsInRange.
+
+// SimilarityParams are the parameters of the similarity metrics besides tversky.
+type SimilarityParams struct {
+	Threshold float64 // in (0, 1]
+
+	// Largest intersection cardinality for which a match is detected, see TverskyParams.
+	MaxCardinality int
+}
+
+func DefaultSimilarityParams() SimilarityParams {
+	return SimilarityParams{
+		Threshold:      0.8,
+		MaxCardinality: TVERSKY_MAX_CARDINALITY,
+	}
+}
+
+func isSimilarityMetric(m MatchingType) bool {
+	return m == MATCHING_JACCARD || m == MATCHING_DICE || m == MATCHING_COSINE || m == MATCHING_OVERLAP
+}
+
+// Integer inequality a|X∩S| - b|X| - c|S| >= 0, or a|X∩S|² - c|X||S| >= 0 if quadratic (b is unused)
+type simInequality struct {
+	quadratic bool
+	a, b, c   uint64
+}
+
+// Inequalities of a similarity metric, a server set matches if one of them holds
+func similarityInequalities(m MatchingType, sp SimilarityParams) ([]simInequality, error) {
+	if sp.Threshold <= 0 || sp.Threshold > 1 {
+		return nil, errors.New("similarity threshold must be in (0, 1]")
+	}
+	if m == MATCHING_JACCARD || m == MATCHING_DICE {
+		w := 1.0
+		if m == MATCHING_DICE {
+			w = 0.5
+		}
+		a, b, c, err := TverskyParams{Alpha: w, Beta: w, Threshold: sp.Threshold}.Coefficients()
+		if err != nil {
+			return nil, err
+		}
+		return []simInequality{{a: a, b: b, c: c}}, nil
+	}
+
+	t := decimalRat(sp.Threshold)
+	if !t.Denom().IsUint64() || t.Denom().Uint64() > math.MaxUint32 {
+		return nil, errors.New("similarity threshold has too many decimals")
+	}
+	p, q := t.Num().Uint64(), t.Denom().Uint64()
+	switch m {
+	case MATCHING_COSINE:
+		return []simInequality{{quadratic: true, a: q * q, c: p * p}}, nil
+	case MATCHING_OVERLAP:
+		return []simInequality{{a: q, b: p}, {a: q, c: p}}, nil
+	}
+	return nil, errors.New("not a similarity metric")
+}
+
+// Largest score of a match with |X∩S| <= maxCard.
+// For fixed |X\S| and |S\X|, scores grow with |X∩S|, and are at most (a-b-c)|X∩S| (or (a-c)|X∩S|²).
+func (in simInequality) maxScore(maxCard int) *big.Int {
+	score := new(big.Int).SetUint64(in.a)
+	score.Sub(score, new(big.Int).SetUint64(in.b))
+	score.Sub(score, new(big.Int).SetUint64(in.c))
+	score.Mul(score, big.NewInt(int64(maxCard)))
+	if in.quadratic {
+		score.Mul(score, big.NewInt(int64(maxCard)))
+	}
+	return score
+}
+
+// Opposite of the smallest score of sets in a domain of the given size
+func (in simInequality) minScoreAbs(domain int) *big.Int {
+	score := new(big.Int).SetUint64(in.b)
+	score.Add(score, new(big.Int).SetUint64(in.c))
+	score.Mul(score, big.NewInt(int64(domain)))
+	if in.quadratic {
+		score.Mul(score, big.NewInt(int64(domain)))
+	}
+	return score
+}
+
+func (in simInequality) score(i, x, s int) int {
+	if in.quadratic {
+		return int(in.a)*i*i - int(in.c)*x*s
+	}
+	return int(in.a)*i - int(in.b)*x - int(in.c)*s
+}
+
+// Bound n of the range check of a similarity metric: matching scores are in [0, n).
+func similarityScoreLimit(m MatchingType, sp SimilarityParams) (int, error) {
+	ineqs, err := similarityInequalities(m, sp)
+	if err != nil {
+		return 0, err
+	}
+	if sp.MaxCardinality < 1 {
+		return 0, errors.New("similarity max cardinality must be positive")
+	}
+	maxScore := big.NewInt(0)
+	for _, in := range ineqs {
+		if score := in.maxScore(sp.MaxCardinality); score.Cmp(maxScore) > 0 {
+			maxScore = score
+		}
+	}
+	if !maxScore.IsInt64() || maxScore.Int64() >= math.MaxInt32 {
+		return 0, errors.New("similarity scores do not fit in 32 bits")
+	}
+	return int(maxScore.Int64()) + 1, nil
+}
+
+// Multiplicative depth of the similarity scores, the range check on scores in [0, scoreLim),
+// and the disjunction of the inequalities
+func similarityDepth(qt QueryType, scoreLim int) int {
+	depth := bits.Len(uint(scoreLim - 1))
+	if qt.Matching == MATCHING_COSINE || qt.Matching == MATCHING_OVERLAP {
+		depth++
+	}
+	return depth
+}
+
+// Verifies that the similarity scores of a query can be evaluated with the given parameters, see checkTverskyParams.
+func checkSimilarityParams(qt QueryType, T uint64, sdBitVecLen, rangeLim, maxDepth int) error {
+	if !isSimilarityMetric(qt.Matching) {
+		return nil
+	}
+	if !qt.IsSmallDomain || qt.Psi != PSI_CA {
+		return errors.New("similarity metrics require small domain psi-ca")
+	}
+	if qt.Aggregation != AGGREGATION_NAIVE && qt.Aggregation != AGGREGATION_X_MS && qt.Aggregation != AGGREGATION_CA_MS {
+		return errors.New("similarity metrics support naive, x-ms, and ca-ms aggregation")
+	}
+	ineqs, err := similarityInequalities(qt.Matching, qt.Similarity)
+	if err != nil {
+		return err
+	}
+	scoreLim, err := similarityScoreLimit(qt.Matching, qt.Similarity)
+	if err != nil {
+		return err
+	}
+
+	// Scores are in [-minScoreAbs, scoreLim)
+	for _, in := range ineqs {
+		span := new(big.Int).Add(in.minScoreAbs(sdBitVecLen), big.NewInt(int64(scoreLim)))
+		if span.Cmp(new(big.Int).SetUint64(T)) >= 0 {
+			return fmt.Errorf("similarity scores (%v values) do not fit in the plaintext modulus %v", span, T)
+		}
+	}
+	if scoreLim > rangeLim {
+		return fmt.Errorf("similarity score limit %v exceeds the range limit of the parameters (%v)", scoreLim, rangeLim)
+	}
+
+	depth := similarityDepth(qt, scoreLim)
+	if maxDepth >= 0 && depth > maxDepth {
+		return fmt.Errorf("similarity matching requires depth %v but the parameters only support %v", depth, maxDepth)
+	}
+	return nil
+}
+
+// SimilarityMatch reports whether sim(client, server) >= sp.Threshold with the integer inequalities of the metric.
+func SimilarityMatch(m MatchingType, sp SimilarityParams, client []uint64, server []uint64) bool {
+	ineqs, err := similarityInequalities(m, sp)
+	if err != nil {
+		panic(err)
+	}
+	I := len(Intersection(client, server))
+	for _, in := range ineqs {
+		if in.score(I, len(client), len(server)) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Plaintext similarity metrics (zero for empty sets)
+
+func PlainJaccard(set1 []uint64, set2 []uint64) float64 {
+	I := len(Intersection(set1, set2))
+	return safeRatio(float64(I), float64(len(set1)+len(set2)-I))
+}
+
+func PlainDice(set1 []uint64, set2 []uint64) float64 {
+	I := len(Intersection(set1, set2))
+	return safeRatio(float64(2*I), float64(len(set1)+len(set2)))
+}
+
+func PlainCosine(set1 []uint64, set2 []uint64) float64 {
+	I := len(Intersection(set1, set2))
+	return safeRatio(float64(I), math.Sqrt(float64(len(set1)*len(set2))))
+}
+
+func PlainOverlap(set1 []uint64, set2 []uint64) float64 {
+	I := len(Intersection(set1, set2))
+	min := len(set1)
+	if len(set2) < min {
+		min = len(set2)
+	}
+	return safeRatio(float64(I), float64(min))
+}
+
+func safeRatio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+// Computes the range checks of the similarity inequalities of every server set from the output of
+// computePSI_CA_SD, batched into the minimal number of ctxs. The result of a set is zero iff it matches.
+func (sv *session) computeSimilarity(query *PsiQuery, intersectionCaCtx []*bfv.Ciphertext) ([]*bfv.Ciphertext, error) {
+	qt := query.queryType
+	ineqs, _ := similarityInequalities(qt.Matching, qt.Similarity)
+	scoreLim, _ := similarityScoreLimit(qt.Matching, qt.Similarity)
+
+	var out []*bfv.Ciphertext
+	for j, in := range ineqs {
+		var scores []*bfv.Ciphertext
+		var err error
+		if in.quadratic {
+			scores, err = sv.computeQuadraticScore(query, intersectionCaCtx, in.a, in.c)
+		} else {
+			scores, err = sv.computeLinearScore(query, intersectionCaCtx, in.a, in.b, in.c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		scores = BatchSIMDctxs(sv.pp, sv.evaluator, scores, sv.pp.SdBitVecLen)
+
+		err = sv.parallelFor(len(scores), func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
+			scores[k] = IsInRange(sv.pp, evaluator, scores[k], scoreLim)
+			if j > 0 {
+				// Zero if one of the inequalities holds
+				scores[k] = evaluator.MulNew(out[k], scores[k])
+				evaluator.Relinearize(scores[k], scores[k])
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		out = scores
+	}
+	return out, nil
+}
+
+// Computes a|X∩S|² - c|X||S| for every server set S from the output of computePSI_CA_SD
+func (sv *session) computeQuadraticScore(query *PsiQuery, intersectionCaCtx []*bfv.Ciphertext, a, c uint64) ([]*bfv.Ciphertext, error) {
+	scores := make([]*bfv.Ciphertext, len(intersectionCaCtx))
+
+	// compute the cardinality of the client's set |X|
+	clientCaCtx := query.ctxs[0].CopyNew().Ciphertext()
+	SumSIMD(sv.evaluator, clientCaCtx, sv.pp.SdBitVecLen)
+
+	err := sv.parallelFor(len(intersectionCaCtx), func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
+		square := evaluator.MulNew(intersectionCaCtx[k], intersectionCaCtx[k])
+		evaluator.Relinearize(square, square)
+		evaluator.MulScalar(square, a, square)
+
+		// set server sets' cardinality c|S_i|
+		serverCaRaw := make([]uint64, sv.pp.params.N())
+		for i := 0; i < sv.pp.sdSetsPerCtx; i++ {
+			if k*sv.pp.sdSetsPerCtx+i < len(sv.sets) {
+				serverCaRaw[i*sv.pp.SdBitVecLen] = c * uint64(len(sv.sets[k*sv.pp.sdSetsPerCtx+i]))
+			}
+		}
+		serverCaPtx := bfv.NewPlaintextMul(sv.pp.params)
+		encoder.EncodeUintMul(serverCaRaw, serverCaPtx)
+
+		product := evaluator.MulNew(clientCaCtx, serverCaPtx)
+		scores[k] = evaluator.SubNew(square, product)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scores, nil
+}
@@ -0,0 +1,79 @@
+package psm
+
+import (
+	"errors"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Small domain psi multiplies the client bit vector X with the bit vector S of every server set
+// and randomizes the product: slot v of the block of S is non-zero iff v ∈ X∩S.
+// Like computePSI_CA_SD, each response ciphertext holds sdSetsPerCtx server sets, one per block.
+
+// Small domain psi reveals the intersections, so it supports neither matching nor aggregation.
+func checkSmallDomainPSIQuery(qt QueryType) error {
+	if !qt.IsSmallDomain || qt.Psi != PSI_PSI {
+		return nil
+	}
+	if qt.Matching != MATCHING_NONE || qt.Aggregation != AGGREGATION_NAIVE {
+		return errors.New("small domain psi supports neither matching nor aggregation")
+	}
+	return nil
+}
+
+func (sv *session) computePSI_SD(query *PsiQuery) ([]*bfv.Ciphertext, error) {
+	params := sv.pp.params
+	ctxs := make([]*bfv.Ciphertext, FitLen(len(sv.sets), sv.pp.sdSetsPerCtx))
+
+	err := sv.parallelFor(len(ctxs), func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
+		bitVec := make([]uint64, params.N())
+		next := (k + 1) * sv.pp.sdSetsPerCtx
+		if next > len(sv.sets) {
+			next = len(sv.sets)
+		}
+		if err := EncodeSetsAsBitVector(sv.sets[k*sv.pp.sdSetsPerCtx:next], sv.pp.SdBitVecLen, bitVec); err != nil {
+			return err
+		}
+		// The selected bits are randomized by the same multiplication
+		for i, bit := range bitVec {
+			if bit == 1 {
+				bitVec[i] = randNonZero(params.T())
+			}
+		}
+
+		selectPtx := bfv.NewPlaintextMul(params)
+		encoder.EncodeUintMul(bitVec, selectPtx)
+		ctxs[k] = evaluator.MulNew(query.ctxs[0], selectPtx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ctxs, nil
+}
+
+// Decodes the response of computePSI_SD: the intersection of the client set with each server set, in server order.
+func (cl *Client) evalSmallDomainIntersections(clientSet []uint64, resp *PsiResponse) [][]uint64 {
+	intersections := make([][]uint64, resp.serverSetNum)
+	for n := range intersections {
+		intersections[n] = make([]uint64, 0, len(clientSet))
+	}
+
+	for k, ctx := range resp.ctxs {
+		respPtx := cl.decryptor.DecryptNew(ctx)
+		respData := cl.encoder.DecodeUintNew(respPtx)
+
+		for i := 0; i < cl.pp.sdSetsPerCtx; i++ {
+			n := k*cl.pp.sdSetsPerCtx + i
+			if n >= resp.serverSetNum {
+				break
+			}
+			for _, v := range clientSet {
+				if v < uint64(cl.pp.SdBitVecLen) && respData[i*cl.pp.SdBitVecLen+int(v)] != 0 {
+					intersections[n] = append(intersections[n], v)
+				}
+			}
+		}
+	}
+	return intersections
+}
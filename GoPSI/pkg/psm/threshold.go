@@ -0,0 +1,192 @@
+package psm
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Threshold aggregation (th-ms) reveals whether at least Threshold server sets match.
+//
+// The matching layers output a randomized value v_i per server set that is zero iff the set matches.
+// Exact 0/1 match bits (and their count) would need IsZero, whose depth does not fit after matching.
+// Instead, the server computes the coefficient of z^(k-1) of prod_i (z + v_i), i.e., the elementary
+// symmetric polynomial e_{n-k+1}(v). Every term of e_{n-k+1} is a product of n-k+1 distinct v_i,
+// so it is zero if at least k of the v_i are zero, and a random value otherwise.
+// The product is computed modulo z^k with the same rotation tree as x-ms, which is the case k = 1.
+
+// Largest threshold of th-ms aggregation: the product tree holds Threshold ciphertexts per
+// polynomial, and each of its multiplications costs Threshold(Threshold+1)/2 ciphertext products.
+const MaxThreshold = 16
+
+// Largest number of ciphertext products of the th-ms product tree
+const maxThresholdProducts = 1 << 15
+
+// Sets match "at least Threshold" of the server sets with f-psm or tversky matching.
+func checkThresholdQuery(qt QueryType) error {
+	if qt.Aggregation != AGGREGATION_TH_MS {
+		return nil
+	}
+	if qt.Threshold < 1 {
+		return errors.New("the threshold of th-ms aggregation must be positive")
+	}
+	if qt.Threshold > MaxThreshold {
+		return fmt.Errorf("the threshold %v of th-ms aggregation exceeds the maximum of %v", qt.Threshold, MaxThreshold)
+	}
+	if qt.Matching != MATCHING_FPSM && qt.Matching != MATCHING_TVERSKY {
+		return errors.New("th-ms aggregation requires f-psm or tversky matching")
+	}
+	return nil
+}
+
+// The server rejects thresholds above its number of sets, which no collection reaches.
+func (sv *Server) checkThreshold(qt QueryType) error {
+	if qt.Aggregation == AGGREGATION_TH_MS && qt.Threshold > len(sv.raw_sets) {
+		return fmt.Errorf("the threshold %v of th-ms aggregation exceeds the %v server sets", qt.Threshold, len(sv.raw_sets))
+	}
+	return nil
+}
+
+// Number of ciphertext products of the product tree over the sets of ctxNum ciphertexts
+// with threshold k: every multiplication of two polynomials takes k(k+1)/2 products.
+func (layout *batchLayout) thresholdProducts(ctxNum, k int) int {
+	merges := bits.Len(uint(layout.m-1)) + bits.Len(uint(layout.strides-1))
+	if layout.rows {
+		merges++
+	}
+	return (ctxNum*merges + ctxNum - 1) * k * (k + 1) / 2
+}
+
+// Polynomial in z with encrypted coefficients, truncated to the degree of the threshold
+type encPoly []*bfv.Ciphertext
+
+// a*b mod z^len(a). The products of a coefficient are relinearized once, after their sum.
+func (a encPoly) mul(evaluator bfv.Evaluator, b encPoly) encPoly {
+	out := make(encPoly, len(a))
+	for j := range out {
+		for i := 0; i <= j; i++ {
+			term := evaluator.MulNew(a[i], b[j-i])
+			if out[j] == nil {
+				out[j] = term
+			} else {
+				evaluator.Add(out[j], term, out[j])
+			}
+		}
+		evaluator.Relinearize(out[j], out[j])
+	}
+	return out
+}
+
+func (a encPoly) rotate(evaluator bfv.Evaluator, k int) encPoly {
+	out := make(encPoly, len(a))
+	for i := range a {
+		out[i] = evaluator.RotateColumnsNew(a[i], k)
+	}
+	return out
+}
+
+func (a encPoly) rotateRows(evaluator bfv.Evaluator) encPoly {
+	out := make(encPoly, len(a))
+	for i := range a {
+		out[i] = evaluator.RotateRowsNew(a[i])
+	}
+	return out
+}
+
+// Returns a ciphertext that is zero in slot 0 iff at least qt.Threshold sets match, and zero in the other slots.
+func (sv *session) aggregateThreshold(qt QueryType, ctxs []*bfv.Ciphertext) ([]*bfv.Ciphertext, error) {
+	params := sv.pp.params
+	N := sv.N
+	stride := batchStride(sv.pp, qt)
+
+	// The product tree, the selection of the set slots, and the randomization
+	layout := newBatchLayout(sv.pp, qt, len(sv.sets))
+	depth := layout.depth(len(ctxs)) + 2
+	if qt.Matching == MATCHING_TVERSKY {
+		scoreLim, _ := qt.Tversky.ScoreLimit()
+		depth += tverskyDepth(qt, scoreLim)
+	}
+	if maxDepth := sv.pp.MaxDepth(); maxDepth >= 0 && depth > maxDepth {
+		return nil, fmt.Errorf("th-ms aggregation requires depth %v but the parameters only support %v", depth, maxDepth)
+	}
+	if products := layout.thresholdProducts(len(ctxs), qt.Threshold); products > maxThresholdProducts {
+		return nil, fmt.Errorf("th-ms aggregation with threshold %v requires %v ciphertext products, more than the %v supported",
+			qt.Threshold, products, maxThresholdProducts)
+	}
+
+	ones := make([]uint64, N)
+	for i := range ones {
+		ones[i] = 1
+	}
+	onesPtx := bfv.NewPlaintext(params)
+	sv.encoder.EncodeUint(ones, onesPtx)
+	onesCtx := sv.encryptor.EncryptNew(onesPtx)
+
+	polys := make([]encPoly, len(ctxs))
+	err := sv.parallelFor(len(ctxs), func(evaluator bfv.Evaluator, encoder bfv.Encoder, k int) error {
+		// Slots without a set are set to 1 (a non-matching value)
+		sel := make([]uint64, N)
+		pad := make([]uint64, N)
+		for i := range pad {
+			pad[i] = 1
+		}
+		for n := 0; n < N && k*N+n < len(sv.sets); n++ {
+			sel[layout.slots[n]], pad[layout.slots[n]] = 1, 0
+		}
+		selPtx := bfv.NewPlaintextMul(params)
+		encoder.EncodeUintMul(sel, selPtx)
+		padPtx := bfv.NewPlaintext(params)
+		encoder.EncodeUint(pad, padPtx)
+		v := evaluator.MulNew(ctxs[k], selPtx)
+		evaluator.Add(v, padPtx, v)
+
+		// z + v
+		poly := make(encPoly, qt.Threshold)
+		poly[0] = v
+		if qt.Threshold > 1 {
+			poly[1] = onesCtx.CopyNew().Ciphertext()
+			for i := 2; i < len(poly); i++ {
+				poly[i] = bfv.NewCiphertext(params, 1)
+			}
+		}
+
+		// Moves the offsets [0, m) of each stride to [i*stride, i*stride + m)
+		for i := range poly {
+			poly[i] = ExtendedRotate(sv.pp, evaluator, poly[i], -(layout.m - 1))
+		}
+		for shift := 1; shift < layout.m; shift *= 2 {
+			poly = poly.mul(evaluator, poly.rotate(evaluator, shift))
+		}
+		for shift := stride; shift < layout.strides*stride; shift *= 2 {
+			poly = poly.mul(evaluator, poly.rotate(evaluator, shift))
+		}
+		if layout.rows {
+			poly = poly.mul(evaluator, poly.rotateRows(evaluator))
+		}
+		polys[k] = poly
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Product over the ciphertexts
+	for n := len(polys); n > 1; n = (n + 1) / 2 {
+		for i := 0; 2*i+1 < n; i++ {
+			polys[i] = polys[2*i].mul(sv.evaluator, polys[2*i+1])
+		}
+		if n%2 == 1 {
+			polys[n/2] = polys[n-1]
+		}
+	}
+
+	// Randomizes slot 0 and zeroes the other slots, which hold the products of other windows
+	raw := make([]uint64, N)
+	raw[0] = randNonZero(params.T())
+	ptx := bfv.NewPlaintextMul(params)
+	sv.encoder.EncodeUintMul(raw, ptx)
+	out := sv.evaluator.MulNew(polys[0][qt.Threshold-1], ptx)
+	return []*bfv.Ciphertext{out}, nil
+}
@@ -0,0 +1,136 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/spring-epfl/private-collection-matching/pkg/psm"
+)
+
+// Client is a stub that runs the psm client against a remote Server.
+type Client struct {
+	cl      *psm.Client
+	baseURL string
+	keyID   string
+
+	HTTPClient *http.Client
+}
+
+// NewClient creates a stub talking to the server at baseURL (e.g. "http://localhost:8080").
+func NewClient(cl *psm.Client, baseURL string) *Client {
+	return &Client{
+		cl:         cl,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// UploadKey sends the client's evaluation key to the server.
+// The upload is skipped if the server already knows the key (e.g., for a client restored with psm.LoadClient).
+// It must be called before the first query.
+func (c *Client) UploadKey() error {
+	key := c.cl.GetKey()
+	id, err := key.ID()
+	if err != nil {
+		return err
+	}
+
+	known, err := c.hasKey(id)
+	if err != nil {
+		return err
+	}
+	if !known {
+		data, err := key.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		body, err := c.do(http.MethodPost, KeyPath, data, nil)
+		if err != nil {
+			return err
+		}
+		if string(body) != id {
+			return fmt.Errorf("transport: server registered the key as %v instead of %v", string(body), id)
+		}
+	}
+	c.keyID = id
+	return nil
+}
+
+func (c *Client) hasKey(id string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+KeyPath, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(KeyIDHeader, id)
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK, nil
+}
+
+// KeyID returns the ID assigned by the server to the uploaded key.
+func (c *Client) KeyID() string {
+	return c.keyID
+}
+
+// Submit sends a query to the server and downloads its response.
+func (c *Client) Submit(query *psm.PsiQuery) (*psm.PsiResponse, error) {
+	if c.keyID == "" {
+		return nil, errors.New("transport: client key is not uploaded")
+	}
+
+	data, err := query.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.do(http.MethodPost, QueryPath, data, map[string]string{KeyIDHeader: c.keyID})
+	if err != nil {
+		return nil, err
+	}
+	return psm.UnmarshalResponse(body)
+}
+
+// Query runs a full query round: building the query, submitting it, and evaluating the response.
+func (c *Client) Query(set []uint64, queryType psm.QueryType) ([]uint64, error) {
+	query, err := c.cl.Query(set, queryType)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Submit(query)
+	if err != nil {
+		return nil, err
+	}
+	return c.cl.EvalResponse(set, query, resp), nil
+}
+
+func (c *Client) do(method, path string, data []byte, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("transport: %v failed with %v: %v", path, res.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
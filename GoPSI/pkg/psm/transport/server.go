@@ -0,0 +1,208 @@
+package transport
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spring-epfl/private-collection-matching/pkg/psm"
+)
+
+// HTTP endpoints exposed by the server.
+// Every request and response body is a message in the psm wire format.
+const (
+	KeyPath   = "/psm/key"
+	QueryPath = "/psm/query"
+
+	KeyIDHeader = "X-Psm-Key-Id"
+)
+
+// Default limit of the size of query bodies (see Server.MaxQuerySize)
+const DefaultMaxQuerySize = 1 << 28
+
+// Server exposes a psm server over HTTP.
+// Clients first upload their evaluation key to `KeyPath` and receive its key ID (see psm.ClientKey.ID).
+// Queries are then posted to `QueryPath` with the key ID in the `KeyIDHeader` header,
+// and the response is returned in the body of the reply.
+// Keys are cached under their ID, so returning clients can check whether their key is known
+// (GET on `KeyPath` with the `KeyIDHeader` header) instead of uploading it again.
+type Server struct {
+	sv *psm.Server
+
+	// If not empty, uploaded keys are also stored in this directory and survive restarts.
+	KeyDir string
+
+	// Largest accepted request bodies. NewServer sets MaxKeySize to psm.Server.MaxKeySize
+	// and MaxQuerySize to DefaultMaxQuerySize.
+	MaxKeySize   int64
+	MaxQuerySize int64
+
+	keysLock sync.RWMutex
+	keys     map[string]*psm.ClientKey
+
+	mux *http.ServeMux
+}
+
+func NewServer(sv *psm.Server) *Server {
+	s := &Server{
+		sv:           sv,
+		MaxKeySize:   sv.MaxKeySize(),
+		MaxQuerySize: DefaultMaxQuerySize,
+		keys:         make(map[string]*psm.ClientKey),
+		mux:          http.NewServeMux(),
+	}
+	s.mux.HandleFunc(KeyPath, s.handleKey)
+	s.mux.HandleFunc(QueryPath, s.handleQuery)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := s.lookupKey(r.Header.Get(KeyIDHeader)); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxKeySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		id, err := s.registerKey(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) registerKey(data []byte) (string, error) {
+	id := psm.KeyIDFromBinary(data)
+	if _, err := s.lookupKey(id); err == nil {
+		psm.Logger.Info().Msgf("transport: client key %v is already registered", id)
+		return id, nil
+	}
+
+	key, err := psm.UnmarshalClientKey(data)
+	if err != nil {
+		return "", err
+	}
+	if err := s.sv.CheckKey(key); err != nil {
+		return "", err
+	}
+	if s.KeyDir != "" {
+		if err := ioutil.WriteFile(s.keyPath(id), data, 0600); err != nil {
+			return "", err
+		}
+	}
+
+	s.keysLock.Lock()
+	s.keys[id] = key
+	s.keysLock.Unlock()
+
+	psm.Logger.Info().Msgf("transport: registered client key %v", id)
+	return id, nil
+}
+
+// Returns a cached key, loading it from KeyDir if needed.
+func (s *Server) lookupKey(id string) (*psm.ClientKey, error) {
+	if !isKeyID(id) {
+		return nil, errors.New("invalid key id")
+	}
+
+	s.keysLock.RLock()
+	key, ok := s.keys[id]
+	s.keysLock.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if s.KeyDir == "" {
+		return nil, errors.New("unknown key id")
+	}
+
+	data, err := ioutil.ReadFile(s.keyPath(id))
+	if os.IsNotExist(err) {
+		return nil, errors.New("unknown key id")
+	} else if err != nil {
+		return nil, err
+	}
+	if psm.KeyIDFromBinary(data) != id {
+		return nil, errors.New("stored key does not match its id")
+	}
+	if key, err = psm.UnmarshalClientKey(data); err != nil {
+		return nil, err
+	}
+	if err := s.sv.CheckKey(key); err != nil {
+		return nil, err
+	}
+
+	s.keysLock.Lock()
+	s.keys[id] = key
+	s.keysLock.Unlock()
+	return key, nil
+}
+
+func (s *Server) keyPath(id string) string {
+	return filepath.Join(s.KeyDir, id+".key")
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, err := s.lookupKey(r.Header.Get(KeyIDHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxQuerySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	query, err := psm.UnmarshalQuery(data)
+	if err == nil {
+		err = query.CheckQuery(s.sv.Params())
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.sv.Respond(query, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if data, err = resp.MarshalBinary(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// Key IDs are hex encoded SHA-256 hashes
+func isKeyID(id string) bool {
+	raw, err := hex.DecodeString(id)
+	return err == nil && len(raw) == 32
+}
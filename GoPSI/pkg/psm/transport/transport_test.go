@@ -0,0 +1,243 @@
+package transport
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/spring-epfl/private-collection-matching/pkg/psm"
+)
+
+func TestLoopback(t *testing.T) {
+	sets, err := psm.RandomDataSet(20, 3, 100, 255)
+	if err != nil {
+		panic(err)
+	}
+	clientSet, serverSets := sets[0], sets[1:]
+
+	qt, err := psm.NewQueryType(true, psm.PSI_CA, psm.MATCHING_NONE, psm.AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+
+	pp := psm.NewPSIParams(psm.GetBFVParam(13), 128)
+	sv, err := psm.NewServer(pp, serverSets)
+	if err != nil {
+		panic(err)
+	}
+	ts := httptest.NewServer(NewServer(sv))
+	defer ts.Close()
+
+	stub := NewClient(psm.NewClient(pp), ts.URL)
+	if _, err := stub.Query(clientSet, *qt); err == nil {
+		t.Error("query without an uploaded key must fail")
+	}
+
+	if err := stub.UploadKey(); err != nil {
+		t.Fatal(err)
+	}
+	ans, err := stub.Query(clientSet, *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, set := range serverSets {
+		if ans[i] != uint64(len(psm.Intersection(clientSet, set))) {
+			t.Errorf("Set %v: cardinality %v, expected %v", i, ans[i], len(psm.Intersection(clientSet, set)))
+		}
+	}
+
+	// unknown key
+	stub.keyID = "unknown"
+	if _, err := stub.Query(clientSet, *qt); err == nil {
+		t.Error("query with an unknown key must fail")
+	}
+}
+
+func TestKeyCache(t *testing.T) {
+	sets, err := psm.RandomDataSet(5, 3, 100, 255)
+	if err != nil {
+		panic(err)
+	}
+	qt, err := psm.NewQueryType(true, psm.PSI_CA, psm.MATCHING_NONE, psm.AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+
+	pp := psm.NewPSIParams(psm.GetBFVParam(13), 128)
+	sv, err := psm.NewServer(pp, sets[1:])
+	if err != nil {
+		panic(err)
+	}
+	keyDir, err := ioutil.TempDir("", "psm-keys")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(keyDir)
+
+	uploads := 0
+	newServer := func() *httptest.Server {
+		s := NewServer(sv)
+		s.KeyDir = keyDir
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost && r.URL.Path == KeyPath {
+				uploads++
+			}
+			s.ServeHTTP(w, r)
+		}))
+	}
+
+	cl := psm.NewClient(pp)
+	ts := newServer()
+	stub := NewClient(cl, ts.URL)
+	if err := stub.UploadKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stub.UploadKey(); err != nil {
+		t.Fatal(err)
+	}
+	ts.Close()
+	if uploads != 1 {
+		t.Errorf("expected a single upload, got %v", uploads)
+	}
+
+	// The client comes back with saved keys after a server restart
+	saved, err := cl.SaveKeys("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := psm.LoadClient(pp, saved, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = newServer()
+	defer ts.Close()
+	stub = NewClient(restored, ts.URL)
+	if err := stub.UploadKey(); err != nil {
+		t.Fatal(err)
+	}
+	if uploads != 1 {
+		t.Errorf("returning client must not upload its key again (%v uploads)", uploads)
+	}
+	if _, err := stub.Query(sets[0], *qt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	sets, err := psm.RandomDataSet(5, 3, 100, 255)
+	if err != nil {
+		panic(err)
+	}
+	qt, err := psm.NewQueryType(true, psm.PSI_CA, psm.MATCHING_NONE, psm.AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+
+	pp := psm.NewPSIParams(psm.GetBFVParam(13), 128)
+	sv, err := psm.NewServer(pp, sets[1:])
+	if err != nil {
+		panic(err)
+	}
+	s := NewServer(sv)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	post := func(data []byte) int {
+		res, err := http.Post(ts.URL+KeyPath, "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// A key of other parameters is rejected at registration
+	other, err := psm.NewClient(psm.NewPSIParams(psm.GetBFVParam(12), 128)).GetKey().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := post(other); status != http.StatusBadRequest {
+		t.Errorf("key of other parameters: status %v, expected %v", status, http.StatusBadRequest)
+	}
+
+	key, err := psm.NewClient(pp).GetKey().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxKeySize = int64(len(key)) - 1
+	if status := post(key); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized key: status %v, expected %v", status, http.StatusRequestEntityTooLarge)
+	}
+	s.MaxKeySize = sv.MaxKeySize()
+
+	stub := NewClient(psm.NewClient(pp), ts.URL)
+	if err := stub.UploadKey(); err != nil {
+		t.Fatal(err)
+	}
+	s.MaxQuerySize = 1024
+	if _, err := stub.Query(sets[0], *qt); err == nil {
+		t.Error("oversized query must fail")
+	}
+}
+
+func TestMismatchedQuery(t *testing.T) {
+	sets, err := psm.RandomDataSet(201, 3, 100, 255)
+	if err != nil {
+		panic(err)
+	}
+	qt, err := psm.NewQueryType(true, psm.PSI_CA, psm.MATCHING_NONE, psm.AGGREGATION_NAIVE)
+	if err != nil {
+		panic(err)
+	}
+
+	pp := psm.NewPSIParams(psm.GetBFVParam(13), 128)
+	sv, err := psm.NewServer(pp, sets[1:], psm.WithWorkers(4))
+	if err != nil {
+		panic(err)
+	}
+	ts := httptest.NewServer(NewServer(sv))
+	defer ts.Close()
+
+	stub := NewClient(psm.NewClient(pp), ts.URL)
+	if err := stub.UploadKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A query encrypted under other parameters is rejected before its evaluation
+	query, err := psm.NewClient(psm.NewPSIParams(psm.GetBFVParam(12), 128)).Query(sets[0], *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := query.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, ts.URL+QueryPath, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(KeyIDHeader, stub.KeyID())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode < 400 || res.StatusCode >= 500 {
+		t.Errorf("query of other parameters: status %v, expected a client error", res.StatusCode)
+	}
+
+	// The server keeps answering
+	ans, err := stub.Query(sets[0], *qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, set := range sets[1:] {
+		if ans[i] != uint64(len(psm.Intersection(sets[0], set))) {
+			t.Errorf("Set %v: cardinality %v, expected %v", i, ans[i], len(psm.Intersection(sets[0], set)))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package psm
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"strconv"
+)
+
+// Tversky similarity: Tv(X, S) = |X∩S| / (|X∩S| + Alpha*|X\S| + Beta*|S\X|).
+// A server set S matches the client set X if Tv(X, S) >= Threshold.
+//
+// The server evaluates the equivalent integer inequality a|X∩S| - b|X| - c|S| >= 0, where
+// a, b, and c are derived from the parameters. Matching scores are in [0, (a-b-c)*MaxCardinality].
+type TverskyParams struct {
+	Alpha     float64
+	Beta      float64
+	Threshold float64 // in (0, 1]
+
+	// Largest intersection cardinality for which a match is detected.
+	// Bounds the range check, hence the multiplicative depth.
+	MaxCardinality int
+}
+
+func DefaultTverskyParams() TverskyParams {
+	return TverskyParams{
+		Alpha:          1,
+		Beta:           1,
+		Threshold:      0.8,
+		MaxCardinality: TVERSKY_MAX_CARDINALITY,
+	}
+}
+
+// Exact rational value of the shortest decimal representation of x (e.g., 0.7 -> 7/10)
+func decimalRat(x float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(x, 'f', -1, 64))
+	return r
+}
+
+// Coefficients returns the smallest integers a, b, c such that
+// Tv(X, S) >= Threshold <=> a|X∩S| - b|X| - c|S| >= 0.
+func (tp TverskyParams) Coefficients() (a, b, c uint64, err error) {
+	if tp.Alpha < 0 || tp.Beta < 0 {
+		return 0, 0, 0, errors.New("tversky alpha and beta must be non-negative")
+	}
+	if tp.Threshold <= 0 || tp.Threshold > 1 {
+		return 0, 0, 0, errors.New("tversky threshold must be in (0, 1]")
+	}
+
+	t, alpha, beta := decimalRat(tp.Threshold), decimalRat(tp.Alpha), decimalRat(tp.Beta)
+
+	// |I| >= t(|I| + alpha(|X|-|I|) + beta(|S|-|I|))
+	// <=> (1 - t + t.alpha + t.beta)|I| - t.alpha|X| - t.beta|S| >= 0
+	tb := new(big.Rat).Mul(t, alpha)
+	tc := new(big.Rat).Mul(t, beta)
+	ta := new(big.Rat).Sub(big.NewRat(1, 1), t)
+	ta.Add(ta, tb)
+	ta.Add(ta, tc)
+
+	// scale to integers
+	lcm := big.NewInt(1)
+	for _, r := range []*big.Rat{ta, tb, tc} {
+		g := new(big.Int).GCD(nil, nil, lcm, r.Denom())
+		lcm.Mul(lcm, new(big.Int).Quo(r.Denom(), g))
+	}
+	coefs := make([]*big.Int, 3)
+	gcd := big.NewInt(0)
+	for i, r := range []*big.Rat{ta, tb, tc} {
+		coefs[i] = new(big.Int).Mul(r.Num(), new(big.Int).Quo(lcm, r.Denom()))
+		gcd.GCD(nil, nil, gcd, coefs[i])
+	}
+	for i := range coefs {
+		coefs[i].Quo(coefs[i], gcd)
+		if !coefs[i].IsUint64() {
+			return 0, 0, 0, errors.New("tversky coefficients do not fit in 64 bits")
+		}
+	}
+	return coefs[0].Uint64(), coefs[1].Uint64(), coefs[2].Uint64(), nil
+}
+
+// ScoreLimit returns the bound n of the range check: matching scores are in [0, n).
+func (tp TverskyParams) ScoreLimit() (int, error) {
+	a, b, c, err := tp.Coefficients()
+	if err != nil {
+		return 0, err
+	}
+	if tp.MaxCardinality < 1 {
+		return 0, errors.New("tversky max cardinality must be positive")
+	}
+	return int(a-b-c)*tp.MaxCardinality + 1, nil
+}
+
+// Matching layers that read the Tversky parameters of the query
+func usesTverskyParams(m MatchingType) bool {
+	return m == MATCHING_TVERSKY || m == MATCHING_TVERSKY_PLAIN
+}
+
+// Verifies that the Tversky scores of a query can be evaluated with the given parameters:
+// scores must not wrap around the plaintext modulus and the range check (and the optional
+// aggregation) must fit in the multiplicative depth. A negative maxDepth skips the depth check.
+func checkTverskyParams(qt QueryType, T uint64, sdBitVecLen, rangeLim, maxDepth int) error {
+	tp := qt.Tversky
+	_, b, c, err := tp.Coefficients()
+	if err != nil {
+		return err
+	}
+	scoreLim, err := tp.ScoreLimit()
+	if err != nil {
+		return err
+	}
+
+	// Scores are in [-(b+c).|domain|, scoreLim)
+	minScore := new(big.Int).SetUint64(b + c)
+	minScore.Mul(minScore, big.NewInt(int64(sdBitVecLen)))
+	span := new(big.Int).Add(minScore, big.NewInt(int64(scoreLim)))
+	if span.Cmp(new(big.Int).SetUint64(T)) >= 0 {
+		return fmt.Errorf("tversky scores (%v values) do not fit in the plaintext modulus %v", span, T)
+	}
+	if qt.Matching == MATCHING_TVERSKY_PLAIN {
+		return nil
+	}
+
+	if scoreLim > rangeLim {
+		return fmt.Errorf("tversky score limit %v exceeds the range limit of the parameters (%v)", scoreLim, rangeLim)
+	}
+
+	depth := tverskyDepth(qt, scoreLim)
+	if maxDepth >= 0 && depth > maxDepth {
+		return fmt.Errorf("tversky matching requires depth %v but the parameters only support %v", depth, maxDepth)
+	}
+	return nil
+}
+
+// Score computes the (integer) Tversky score of the client set and a server set in plaintext.
+func (tp TverskyParams) Score(client []uint64, server []uint64) int {
+	a, b, c, err := tp.Coefficients()
+	if err != nil {
+		panic(err)
+	}
+
+	I := Intersection(client, server)
+	return int(a)*len(I) - int(b)*len(client) - int(c)*len(server)
+}
+
+// Multiplicative depth of the range check on scores in [0, scoreLim) and of the x-ms aggregation
+func tverskyDepth(qt QueryType, scoreLim int) int {
+	depth := bits.Len(uint(scoreLim - 1))
+	if qt.Aggregation == AGGREGATION_X_MS {
+		depth += TVERSKY_X_MS_DEPTH
+	}
+	return depth
+}
@@ -1,9 +1,15 @@
 package psm
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
 	"strings"
 
 	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/rlwe"
 )
 
 type PsiType int
@@ -25,6 +31,14 @@ const (
 	MATCHING_TVERSKY
 	MATCHING_TVERSKY_PLAIN
 	MATCHING_FPSM
+	MATCHING_FPSM_SUBSET   // small domain: client set ⊆ server set
+	MATCHING_FPSM_SUPERSET // small domain: server set ⊆ client set
+	MATCHING_FPSM_EQUAL    // small domain: client set = server set
+	MATCHING_JACCARD       // similarity metrics, see similarity.go
+	MATCHING_DICE
+	MATCHING_COSINE
+	MATCHING_OVERLAP
+	MATCHING_HAMMING // small domain: bit vectors at distance at most HammingRadius, see hamming.go
 )
 
 var matchingTypeMap = map[string]MatchingType{
@@ -32,6 +46,15 @@ var matchingTypeMap = map[string]MatchingType{
 	"tversky":       MATCHING_TVERSKY,
 	"tversky-plain": MATCHING_TVERSKY_PLAIN,
 	"fpsm":          MATCHING_FPSM,
+	"fpsm-subset":   MATCHING_FPSM_SUBSET,
+	"fpsm-superset": MATCHING_FPSM_SUPERSET,
+	"fpsm-equal":    MATCHING_FPSM_EQUAL,
+	"jaccard":       MATCHING_JACCARD,
+	"tanimoto":      MATCHING_JACCARD,
+	"dice":          MATCHING_DICE,
+	"cosine":        MATCHING_COSINE,
+	"overlap":       MATCHING_OVERLAP,
+	"hamming":       MATCHING_HAMMING,
 }
 
 type AggregationType int
@@ -40,19 +63,27 @@ const (
 	AGGREGATION_NAIVE AggregationType = iota
 	AGGREGATION_X_MS
 	AGGREGATION_CA_MS
+	AGGREGATION_TH_MS
 )
 
 var aggregationTypeMap = map[string]AggregationType{
 	"naive": AGGREGATION_NAIVE,
 	"x-ms":  AGGREGATION_X_MS,
 	"ca-ms": AGGREGATION_CA_MS,
+	"th-ms": AGGREGATION_TH_MS,
 }
 
 type QueryType struct {
 	IsSmallDomain bool
-	Psi           PsiType         // [psi, psi-ca]
-	Matching      MatchingType    // [fpsm, tversky, tversky-plain]
-	Aggregation   AggregationType // [x-ms, ca-ms, ""]
+	Psi           PsiType          // [psi, psi-ca]
+	Matching      MatchingType     // [fpsm, fpsm-subset, fpsm-superset, fpsm-equal, tversky, tversky-plain, jaccard, dice, cosine, overlap, hamming]
+	Aggregation   AggregationType  // [x-ms, ca-ms, th-ms, ""]
+	Tversky       TverskyParams    // tversky matching
+	Similarity    SimilarityParams // jaccard, dice, cosine, and overlap matching
+	WithLabels    bool             // reveal the labels of the matching sets (see NewLabeledServer)
+	Threshold     int              // th-ms: reveals whether at least Threshold sets match
+	HammingRadius int              // hamming: largest distance of the matching sets
+	PackedQueries int              // small domain psi-ca: number of client sets packed in the query (see Client.QueryBatch)
 }
 
 func ParsePsiString(str *string) (PsiType, bool) {
@@ -71,57 +102,545 @@ func ParseAggregationString(str *string) (AggregationType, bool) {
 }
 
 func NewQueryType(use_small_domain bool, psi PsiType, psm MatchingType, aggregation AggregationType) (*QueryType, error) {
-	return &QueryType{use_small_domain, psi, psm, aggregation}, nil
+	return &QueryType{use_small_domain, psi, psm, aggregation, DefaultTverskyParams(), DefaultSimilarityParams(), false, 0, 0, 0}, nil
 }
 
-type clientKey struct {
+// Limits of the parameters on the queries, see checkQuery
+type queryLimits struct {
+	N           int
+	T           uint64
+	SdBitVecLen int
+	RangeLim    int
+	MaxDepth    int // -1 if unknown
+}
+
+func (pp *PSIParams) queryLimits() queryLimits {
+	return queryLimits{int(pp.params.N()), pp.params.T(), pp.SdBitVecLen, len(pp.rangePtxs), pp.MaxDepth()}
+}
+
+// Checks that the parameters support the query, for both the client and the server.
+func checkQuery(pp *PSIParams, qt QueryType) error {
+	return checkQueryLimits(qt, pp.queryLimits())
+}
+
+func checkQueryLimits(qt QueryType, lim queryLimits) error {
+	if err := checkQueryType(qt); err != nil {
+		return err
+	}
+	if err := checkSimilarityParams(qt, lim.T, lim.SdBitVecLen, lim.RangeLim, lim.MaxDepth); err != nil {
+		return err
+	}
+	if err := checkHammingParams(qt, lim.RangeLim, lim.MaxDepth); err != nil {
+		return err
+	}
+	if err := checkPackedParams(qt, lim.N, lim.SdBitVecLen); err != nil {
+		return err
+	}
+	if qt.Matching == MATCHING_TVERSKY || qt.Matching == MATCHING_TVERSKY_PLAIN {
+		return checkTverskyParams(qt, lim.T, lim.SdBitVecLen, lim.RangeLim, lim.MaxDepth)
+	}
+	return nil
+}
+
+// Checks the combination of layers of the query, whatever the parameters
+func checkQueryType(qt QueryType) error {
+	if err := checkLabelQuery(qt); err != nil {
+		return err
+	}
+	if err := checkThresholdQuery(qt); err != nil {
+		return err
+	}
+	if err := checkSmallDomainFPSMQuery(qt); err != nil {
+		return err
+	}
+	return checkSmallDomainPSIQuery(qt)
+}
+
+type ClientKey struct {
 	pk  *bfv.PublicKey
 	evk *bfv.EvaluationKey
+
+	id string // cached key ID
 }
 
-type psiQuery struct {
+type PsiQuery struct {
 	queryType     QueryType
 	clientSetSize int
-	ctx           *bfv.Ciphertext
+	ctxs          []*bfv.Ciphertext // one per MaxClientElemPerCtx client elements (large domain)
+}
+
+type PsiResponse struct {
+	serverSetNum int
+	ctxs         []*bfv.Ciphertext
+
+	// Only for queries with labels, see sealLabels
+	labelCtxs []*bfv.Ciphertext
+	labels    [][]byte
+}
+
+//////////////////////////////////
+//         Wire format          //
+//////////////////////////////////
+
+// Every message starts with a one byte message tag and a one byte format version.
+// Variable-length fields are written as an 8-byte big-endian length followed by the payload.
+// Version 2 adds the query flags and parameters and the queries with several ciphertexts,
+// so messages of version 1 are rejected.
+const WIRE_FORMAT_VERSION = 2
+
+// Flags of the query type
+const (
+	wireFlagSmallDomain byte = 1 << iota
+	wireFlagLabels
+	wireFlagPacked
+)
+
+const (
+	wireTagClientKey byte = iota + 1
+	wireTagQuery
+	wireTagResponse
+	wireTagClientSecret
+)
+
+func writeWireHeader(tag byte) []byte {
+	return []byte{tag, WIRE_FORMAT_VERSION}
+}
+
+func readWireHeader(data []byte, tag byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, errors.New("wire: message too short")
+	}
+	if data[0] != tag {
+		return nil, fmt.Errorf("wire: unexpected message tag %v (expected %v)", data[0], tag)
+	}
+	if data[1] < WIRE_FORMAT_VERSION {
+		return nil, fmt.Errorf("wire: format version %v is no longer supported (expected %v)", data[1], WIRE_FORMAT_VERSION)
+	}
+	if data[1] != WIRE_FORMAT_VERSION {
+		return nil, fmt.Errorf("wire: unsupported format version %v", data[1])
+	}
+	return data[2:], nil
+}
+
+func writeWireUint(data []byte, v uint64) []byte {
+	var buff [8]byte
+	binary.BigEndian.PutUint64(buff[:], v)
+	return append(data, buff[:]...)
+}
+
+func readWireUint(data []byte) (uint64, []byte, error) {
+	if len(data) < 8 {
+		return 0, nil, errors.New("wire: truncated integer")
+	}
+	return binary.BigEndian.Uint64(data[:8]), data[8:], nil
 }
 
-func (key *clientKey) MarshalBinary() (data []byte, err error) {
+func writeWireBlob(data, blob []byte) []byte {
+	data = writeWireUint(data, uint64(len(blob)))
+	return append(data, blob...)
+}
+
+func readWireBlob(data []byte) ([]byte, []byte, error) {
+	l, data, err := readWireUint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint64(len(data)) < l {
+		return nil, nil, errors.New("wire: truncated payload")
+	}
+	return data[:l], data[l:], nil
+}
+
+func writeWireCiphertext(data []byte, ctx *bfv.Ciphertext) ([]byte, error) {
+	buff, err := ctx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return writeWireBlob(data, buff), nil
+}
+
+func readWireCiphertext(data []byte) (*bfv.Ciphertext, []byte, error) {
+	buff, data, err := readWireBlob(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(buff) == 0 {
+		return nil, nil, errors.New("wire: empty ciphertext")
+	}
+	ctx := new(bfv.Ciphertext)
+	if err = ctx.UnmarshalBinary(buff); err != nil {
+		return nil, nil, err
+	}
+	return ctx, data, nil
+}
+
+// Rotation keys are written in increasing order of Galois elements so that the encoding
+// of a key is deterministic (lattigo writes them in map order).
+func writeWireRotationKeys(data []byte, rtks *bfv.RotationKeySet) ([]byte, error) {
+	galEls := make([]uint64, 0, len(rtks.Keys))
+	for galEl := range rtks.Keys {
+		galEls = append(galEls, galEl)
+	}
+	sort.Slice(galEls, func(i, j int) bool { return galEls[i] < galEls[j] })
+
+	data = writeWireUint(data, uint64(len(galEls)))
+	for _, galEl := range galEls {
+		buff, err := rtks.Keys[galEl].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		data = writeWireUint(data, galEl)
+		data = writeWireBlob(data, buff)
+	}
+	return data, nil
+}
+
+func readWireRotationKeys(data []byte) (*bfv.RotationKeySet, []byte, error) {
+	var num, galEl uint64
+	var buff []byte
+	var err error
+	if num, data, err = readWireUint(data); err != nil {
+		return nil, nil, err
+	}
+	// every key takes at least its galois element and length prefix
+	if num > uint64(len(data))/16 {
+		return nil, nil, errors.New("wire: invalid rotation key count")
+	}
+
+	keys := make(map[uint64]*rlwe.SwitchingKey, num)
+	for i := uint64(0); i < num; i++ {
+		if galEl, data, err = readWireUint(data); err != nil {
+			return nil, nil, err
+		}
+		if buff, data, err = readWireBlob(data); err != nil {
+			return nil, nil, err
+		}
+		if len(buff) == 0 {
+			return nil, nil, errors.New("wire: empty rotation key")
+		}
+		swk := new(rlwe.SwitchingKey)
+		if err = swk.UnmarshalBinary(buff); err != nil {
+			return nil, nil, err
+		}
+		keys[galEl] = swk
+	}
+	return &bfv.RotationKeySet{RotationKeySet: rlwe.RotationKeySet{Keys: keys}}, data, nil
+}
+
+func (key *ClientKey) MarshalBinary() (data []byte, err error) {
 	var buff []byte
-	if data, err = key.pk.MarshalBinary(); err != nil {
+	data = writeWireHeader(wireTagClientKey)
+	if buff, err = key.pk.MarshalBinary(); err != nil {
 		return nil, err
 	}
+	data = writeWireBlob(data, buff)
 	if buff, err = key.evk.Rlk.MarshalBinary(); err != nil {
 		return nil, err
 	}
-	data = append(data, buff...)
-	if buff, err = key.evk.Rtks.MarshalBinary(); err != nil {
+	data = writeWireBlob(data, buff)
+	if data, err = writeWireRotationKeys(data, key.evk.Rtks); err != nil {
 		return nil, err
 	}
-	data = append(data, buff...)
 	return data, nil
 }
-func (query *psiQuery) MarshalBinary() (data []byte, err error) {
+
+func (key *ClientKey) UnmarshalBinary(data []byte) (err error) {
 	var buff []byte
-	if buff, err = query.ctx.MarshalBinary(); err != nil {
-		return nil, err
+	if data, err = readWireHeader(data, wireTagClientKey); err != nil {
+		return err
+	}
+
+	pk := new(bfv.PublicKey)
+	if buff, data, err = readWireBlob(data); err != nil {
+		return err
+	}
+	if err = pk.UnmarshalBinary(buff); err != nil {
+		return err
+	}
+
+	rlk := new(bfv.RelinearizationKey)
+	if buff, data, err = readWireBlob(data); err != nil {
+		return err
+	}
+	if err = rlk.UnmarshalBinary(buff); err != nil {
+		return err
+	}
+
+	rtks, data, err := readWireRotationKeys(data)
+	if err != nil {
+		return err
+	}
+
+	if len(data) != 0 {
+		return errors.New("wire: trailing bytes after client key")
+	}
+
+	key.pk = pk
+	key.evk = &bfv.EvaluationKey{Rlk: rlk, Rtks: rtks}
+	return nil
+}
+
+func (query *PsiQuery) MarshalBinary() (data []byte, err error) {
+	data = writeWireHeader(wireTagQuery)
+	qt := query.queryType
+	flags := byte(0)
+	if qt.IsSmallDomain {
+		flags |= wireFlagSmallDomain
+	}
+	if qt.WithLabels {
+		flags |= wireFlagLabels
+	}
+	if qt.PackedQueries != 0 {
+		flags |= wireFlagPacked
+	}
+	data = append(data, flags, byte(qt.Psi), byte(qt.Matching), byte(qt.Aggregation))
+	if usesTverskyParams(qt.Matching) {
+		data = writeWireUint(data, math.Float64bits(qt.Tversky.Alpha))
+		data = writeWireUint(data, math.Float64bits(qt.Tversky.Beta))
+		data = writeWireUint(data, math.Float64bits(qt.Tversky.Threshold))
+		data = writeWireUint(data, uint64(qt.Tversky.MaxCardinality))
+	}
+	if isSimilarityMetric(qt.Matching) {
+		data = writeWireUint(data, math.Float64bits(qt.Similarity.Threshold))
+		data = writeWireUint(data, uint64(qt.Similarity.MaxCardinality))
+	}
+	if qt.Aggregation == AGGREGATION_TH_MS {
+		data = writeWireUint(data, uint64(qt.Threshold))
+	}
+	if qt.Matching == MATCHING_HAMMING {
+		data = writeWireUint(data, uint64(qt.HammingRadius))
+	}
+	if qt.PackedQueries != 0 {
+		data = writeWireUint(data, uint64(qt.PackedQueries))
+	}
+	data = writeWireUint(data, uint64(query.clientSetSize))
+	// The ciphertexts run until the end of the message
+	for _, ctx := range query.ctxs {
+		if data, err = writeWireCiphertext(data, ctx); err != nil {
+			return nil, err
+		}
 	}
-	data = append(data, buff...)
-	// missing type and size
 	return data, nil
 }
 
-type psiResponse struct {
-	serverSetNum int
-	ctxs         []*bfv.Ciphertext
+func (query *PsiQuery) UnmarshalBinary(data []byte) (err error) {
+	var size, alpha, beta, threshold, maxCard uint64
+	if data, err = readWireHeader(data, wireTagQuery); err != nil {
+		return err
+	}
+	if len(data) < 4 {
+		return errors.New("wire: truncated query type")
+	}
+	if data[0]&^(wireFlagSmallDomain|wireFlagLabels|wireFlagPacked) != 0 {
+		return errors.New("wire: invalid query flags")
+	}
+	flags := data[0]
+	qt := QueryType{
+		IsSmallDomain: flags&wireFlagSmallDomain != 0,
+		WithLabels:    flags&wireFlagLabels != 0,
+		Psi:           PsiType(data[1]),
+		Matching:      MatchingType(data[2]),
+		Aggregation:   AggregationType(data[3]),
+		Tversky:       DefaultTverskyParams(),
+		Similarity:    DefaultSimilarityParams(),
+	}
+	if qt.Psi > PSI_CA || qt.Matching > MATCHING_HAMMING || qt.Aggregation > AGGREGATION_TH_MS {
+		return errors.New("wire: invalid query type")
+	}
+	data = data[4:]
+
+	if usesTverskyParams(qt.Matching) {
+		if alpha, data, err = readWireUint(data); err != nil {
+			return err
+		}
+		if beta, data, err = readWireUint(data); err != nil {
+			return err
+		}
+		if threshold, data, err = readWireUint(data); err != nil {
+			return err
+		}
+		if maxCard, data, err = readWireUint(data); err != nil {
+			return err
+		}
+		qt.Tversky = TverskyParams{
+			Alpha:          math.Float64frombits(alpha),
+			Beta:           math.Float64frombits(beta),
+			Threshold:      math.Float64frombits(threshold),
+			MaxCardinality: int(maxCard),
+		}
+	}
+	if isSimilarityMetric(qt.Matching) {
+		if threshold, data, err = readWireUint(data); err != nil {
+			return err
+		}
+		if maxCard, data, err = readWireUint(data); err != nil {
+			return err
+		}
+		qt.Similarity = SimilarityParams{
+			Threshold:      math.Float64frombits(threshold),
+			MaxCardinality: int(maxCard),
+		}
+	}
+	if qt.Aggregation == AGGREGATION_TH_MS {
+		var threshold uint64
+		if threshold, data, err = readWireUint(data); err != nil {
+			return err
+		}
+		qt.Threshold = int(threshold)
+	}
+	if qt.Matching == MATCHING_HAMMING {
+		var radius uint64
+		if radius, data, err = readWireUint(data); err != nil {
+			return err
+		}
+		qt.HammingRadius = int(radius)
+	}
+	if flags&wireFlagPacked != 0 {
+		var queryNum uint64
+		if queryNum, data, err = readWireUint(data); err != nil {
+			return err
+		}
+		qt.PackedQueries = int(queryNum)
+	}
+
+	if size, data, err = readWireUint(data); err != nil {
+		return err
+	}
+	ctxs := make([]*bfv.Ciphertext, 0, 1)
+	for len(ctxs) == 0 || len(data) != 0 {
+		var ctx *bfv.Ciphertext
+		if ctx, data, err = readWireCiphertext(data); err != nil {
+			return err
+		}
+		ctxs = append(ctxs, ctx)
+	}
+
+	query.queryType = qt
+	query.clientSetSize = int(size)
+	query.ctxs = ctxs
+	return nil
 }
 
-func (resp psiResponse) MarshalBinary() (data []byte, err error) {
-	var buff []byte
+func (resp *PsiResponse) MarshalBinary() (data []byte, err error) {
+	data = writeWireHeader(wireTagResponse)
+	data = writeWireUint(data, uint64(resp.serverSetNum))
+	data = writeWireUint(data, uint64(len(resp.ctxs)))
 	for _, ctx := range resp.ctxs {
-		if buff, err = ctx.MarshalBinary(); err != nil {
+		if data, err = writeWireCiphertext(data, ctx); err != nil {
+			return nil, err
+		}
+	}
+	// Labels are appended only when present, so responses without labels keep the first encoding
+	if resp.labels == nil {
+		return data, nil
+	}
+	data = writeWireUint(data, uint64(len(resp.labelCtxs)))
+	for _, ctx := range resp.labelCtxs {
+		if data, err = writeWireCiphertext(data, ctx); err != nil {
 			return nil, err
 		}
-		data = append(data, buff...)
+	}
+	data = writeWireUint(data, uint64(len(resp.labels)))
+	for _, label := range resp.labels {
+		data = writeWireBlob(data, label)
 	}
 	return data, nil
 }
+
+func (resp *PsiResponse) UnmarshalBinary(data []byte) (err error) {
+	var setNum, ctxNum uint64
+	if data, err = readWireHeader(data, wireTagResponse); err != nil {
+		return err
+	}
+	if setNum, data, err = readWireUint(data); err != nil {
+		return err
+	}
+	if ctxNum, data, err = readWireUint(data); err != nil {
+		return err
+	}
+	// every ciphertext takes at least its length prefix
+	if ctxNum > uint64(len(data))/8 {
+		return errors.New("wire: invalid ciphertext count")
+	}
+
+	ctxs := make([]*bfv.Ciphertext, ctxNum)
+	for i := range ctxs {
+		if ctxs[i], data, err = readWireCiphertext(data); err != nil {
+			return err
+		}
+	}
+
+	var labelCtxs []*bfv.Ciphertext
+	var labels [][]byte
+	if len(data) != 0 {
+		if labelCtxs, labels, data, err = readWireLabels(data); err != nil {
+			return err
+		}
+	}
+	if len(data) != 0 {
+		return errors.New("wire: trailing bytes after response")
+	}
+
+	resp.serverSetNum = int(setNum)
+	resp.ctxs = ctxs
+	resp.labelCtxs = labelCtxs
+	resp.labels = labels
+	return nil
+}
+
+func readWireLabels(data []byte) ([]*bfv.Ciphertext, [][]byte, []byte, error) {
+	var ctxNum, labelNum uint64
+	var err error
+	if ctxNum, data, err = readWireUint(data); err != nil {
+		return nil, nil, nil, err
+	}
+	if ctxNum > uint64(len(data))/8 {
+		return nil, nil, nil, errors.New("wire: invalid ciphertext count")
+	}
+	ctxs := make([]*bfv.Ciphertext, ctxNum)
+	for i := range ctxs {
+		if ctxs[i], data, err = readWireCiphertext(data); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if labelNum, data, err = readWireUint(data); err != nil {
+		return nil, nil, nil, err
+	}
+	if labelNum > uint64(len(data))/8 {
+		return nil, nil, nil, errors.New("wire: invalid label count")
+	}
+	labels := make([][]byte, labelNum)
+	for i := range labels {
+		if labels[i], data, err = readWireBlob(data); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return ctxs, labels, data, nil
+}
+
+// Decoders for messages received from another process.
+
+func UnmarshalClientKey(data []byte) (*ClientKey, error) {
+	key := new(ClientKey)
+	if err := key.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func UnmarshalQuery(data []byte) (*PsiQuery, error) {
+	query := new(PsiQuery)
+	if err := query.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+func UnmarshalResponse(data []byte) (*PsiResponse, error) {
+	resp := new(PsiResponse)
+	if err := resp.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
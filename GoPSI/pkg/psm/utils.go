@@ -5,13 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/bits"
 	"math/rand"
 	"os"
 
 	"github.com/ldsec/lattigo/v2/bfv"
 )
 
-func (cl *client) describeCiphertxt(ctx *bfv.Ciphertext, shorten bool) string {
+func (cl *Client) describeCiphertxt(ctx *bfv.Ciphertext, shorten bool) string {
 	ptx := cl.decryptor.DecryptNew(ctx)
 	data := cl.encoder.DecodeUintNew(ptx)
 	if shorten {
@@ -118,11 +119,9 @@ func EncodeSetsAsBitVector(sets [][]uint64, bitLen int, dest []uint64) error {
 	return nil
 }
 
+// Tversky score with the default parameters (alpha = beta = 1, t = 80%)
 func PlainTversky(set1 []uint64, set2 []uint64) int {
-	var a, b, c int = 9, 4, 4
-
-	I := Intersection(set1, set2)
-	return a*len(I) - b*len(set1) - c*len(set2)
+	return DefaultTverskyParams().Score(set1, set2)
 }
 
 func PlainTverskyArray(client []uint64, servers [][]uint64) []int {
@@ -155,14 +154,14 @@ func ReversePlainVec(elems []uint64) []uint64 {
 	return out
 }
 
+// Random vector in [0, max)^size (or [1, max)^size) drawn from RandSource
 func GenRandomVector(size, max uint64, allowZero bool) []uint64 {
 	data := make([]uint64, size)
 	for i := 0; i < int(size); i++ {
-		// Warning: USE CRYPTO SECURE RANDOMNESS
 		if allowZero {
-			data[i] = rand.Uint64() % max
+			data[i] = randUint64n(max)
 		} else {
-			data[i] = (rand.Uint64() % (max - 1)) + 1
+			data[i] = randNonZero(max)
 		}
 	}
 	return data
@@ -211,7 +210,7 @@ func rearrangeFPSIResp(resp []uint64, pp *PSIParams) []uint64 {
 	N := int(pp.params.N())
 	rowN := N / 2
 
-	batchSize := rowN / pp.ClRepNum
+	batchSize := rowN / pp.ldSetsPerCtx
 	setsPerRow := rowN / batchSize
 
 	out := make([]uint64, N)
@@ -230,7 +229,7 @@ func rearrangeFPSIResp(resp []uint64, pp *PSIParams) []uint64 {
 func createFPSImask(l int, pp *PSIParams) []uint64 {
 	N := int(pp.params.N())
 	rowN := N / 2
-	batchSize := rowN / pp.ClRepNum
+	batchSize := rowN / pp.ldSetsPerCtx
 	setsPerRow := rowN / batchSize
 
 	out := make([]uint64, N)
@@ -247,6 +246,64 @@ func createFPSImask(l int, pp *PSIParams) []uint64 {
 	return out
 }
 
+// Distance between the slots of consecutive sets of a batched response ciphertext with the same rotation offset
+func batchStride(pp *PSIParams, qt QueryType) int {
+	if qt.Matching == MATCHING_FPSM {
+		return int(pp.params.N()) / 2 / pp.ldSetsPerCtx
+	}
+	return pp.SdBitVecLen
+}
+
+// Slots of the sets of a batched response ciphertext.
+// Batched responses hold the result of set (k, i) at slot i*stride - k (in its row), see rearrangeResp.
+// The product trees of the aggregations first rotate the slots by m-1, so that the offsets k < m of
+// each stride are consecutive, then multiply m slots, strides strides and, if needed, the two rows.
+type batchLayout struct {
+	slots   []uint64 // slot of every set
+	m       int
+	strides int
+	rows    bool
+}
+
+func newBatchLayout(pp *PSIParams, qt QueryType, setNum int) *batchLayout {
+	N := int(pp.params.N())
+	rowN := N / 2
+	stride := batchStride(pp, qt)
+
+	layout := &batchLayout{slots: make([]uint64, N), m: 1, strides: 1}
+	for i := range layout.slots {
+		layout.slots[i] = uint64(i)
+	}
+	layout.slots = rearrangeResp(pp, qt, layout.slots)
+	if setNum > N {
+		setNum = N
+	}
+	for _, slot := range layout.slots[:setNum] {
+		if offset := (stride-int(slot)%stride)%stride + 1; offset > layout.m {
+			layout.m = offset
+		}
+	}
+	for _, slot := range layout.slots[:setNum] {
+		col := (int(slot)%rowN + layout.m - 1) % rowN
+		if col/stride+1 > layout.strides {
+			layout.strides = col/stride + 1
+		}
+		if int(slot) >= rowN {
+			layout.rows = true
+		}
+	}
+	return layout
+}
+
+// Multiplicative depth of the product tree over the sets of ctxNum ciphertexts
+func (layout *batchLayout) depth(ctxNum int) int {
+	depth := bits.Len(uint(layout.m-1)) + bits.Len(uint(layout.strides-1)) + bits.Len(uint(ctxNum-1))
+	if layout.rows {
+		depth++
+	}
+	return depth
+}
+
 func convertToInt(pp *PSIParams, elems []uint64) []int {
 	out := make([]int, len(elems))
 	T := int(pp.params.T())
@@ -289,7 +346,7 @@ func MultPlainPloyWithRand(pp *PSIParams, poly []uint64) []uint64 {
 	T := pp.params.T()
 
 	out := make([]uint64, len(poly))
-	r := rand.Uint64()%uint64(T-1) + 1
+	r := randNonZero(T)
 
 	for i := 0; i < len(poly); i++ {
 		out[i] = (poly[i] * r) % T
@@ -298,11 +355,30 @@ func MultPlainPloyWithRand(pp *PSIParams, poly []uint64) []uint64 {
 	return out
 }
 
+// Slot holding the k-th client element of the rep-th replica in a large domain ciphertext.
+// The first half of the elements are packed in the first row, the rest in the second row.
+func largeDomainSlot(pp *PSIParams, rep, k int) int {
+	half := pp.MaxClientElemPerCtx / 2
+	slot := (rep*half + k%half) * pp.ClientPolyExpansion
+	if k >= half {
+		slot += int(pp.params.N()) / 2
+	}
+	return slot
+}
+
 // How many batches (with m slots) is needed to fit x elements
 func FitLen(x, m int) int {
 	return (x + m - 1) / m
 }
 
+// Smallest power of 2 larger or equal to n
+func NextPow2(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
 func ReadCompoundsFromFile(path string, chemNum int) [][]uint64 {
 	sets := make([][]uint64, chemNum)
 